@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certReloadInterval is how long a loaded serving certificate is reused before
+// it is re-read from disk.
+const certReloadInterval = 10 * time.Second
+
+// tlsCipherSuites are the cipher suites offered for TLS 1.2: ECDHE key
+// exchange with AEAD ciphers only. TLS 1.3 suites are not configurable.
+var tlsCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+// parseTLSVersion parses a TLS_MIN_VERSION value. Only 1.2 and 1.3 are
+// accepted; older versions are deliberately not supported.
+func parseTLSVersion(s string) (uint16, error) {
+	switch s {
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unsupported TLS version %q, want 1.2 or 1.3", s)
+}
+
+// loadClientCAs reads a PEM CA bundle used to verify client certificates.
+func loadClientCAs(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading client CA bundle: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in client CA bundle %s", path)
+	}
+	return pool, nil
+}
+
+// serverTLSConfig returns the admission server's TLS configuration: the
+// serving certificate, reloaded from disk, the minimum version and cipher
+// suites, and client certificate verification when CLIENT_CA_FILE is set.
+func serverTLSConfig(cfg Config) (*tls.Config, error) {
+	certs, err := newCertReloader(cfg.TLSCertFile, cfg.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		MinVersion:     cfg.TLSMinVersion,
+		CipherSuites:   tlsCipherSuites,
+	}
+	if cfg.ClientCAFile != "" {
+		clientCAs, err := loadClientCAs(cfg.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		// Certificates are verified when presented but only required by the
+		// admission endpoints, so kubelet probes and metrics scrapes still
+		// get through.
+		tlsConfig.ClientCAs = clientCAs
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConfig, nil
+}
+
+// requireClientCert wraps a handler so that, when CLIENT_CA_FILE is set, it
+// refuses requests without a client certificate verified against it. The
+// TLS handshake only verifies certificates that are presented, so the check
+// is made here for the endpoints that need it.
+func (wh *Webhook) requireClientCert(next http.HandlerFunc) http.HandlerFunc {
+	if wh.config.ClientCAFile == "" {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			http.Error(w, "Client certificate required", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// findCertPair looks in dir for a certificate and key named <name>.crt and
+// <name>.key that load as a valid pair, trying names in sorted order, and
+// returns the first it finds.
+func findCertPair(dir string) (certFile, keyFile string, err error) {
+	certFiles, err := filepath.Glob(filepath.Join(dir, "*.crt"))
+	if err != nil {
+		return "", "", err
+	}
+	sort.Strings(certFiles)
+	for _, certFile := range certFiles {
+		keyFile := strings.TrimSuffix(certFile, ".crt") + ".key"
+		if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+			slog.Debug("Skipping TLS certificate candidate", "certFile", certFile, "keyFile", keyFile, "error", err)
+			continue
+		}
+		return certFile, keyFile, nil
+	}
+	return "", "", fmt.Errorf("no valid *.crt/*.key pair found in %s", dir)
+}
+
+// fileExists reports whether path exists.
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// certReloader serves the TLS certificate from disk, re-reading it
+// periodically so rotated certificates are picked up without a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu     sync.Mutex
+	cert   *tls.Certificate
+	loaded time.Time
+}
+
+// newCertReloader returns a certReloader for the given files, loading them
+// once up front so a missing or invalid certificate fails fast.
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := r.GetCertificate(nil); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.cert != nil && time.Since(r.loaded) < certReloadInterval {
+		return r.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		// Keep serving the previous certificate, e.g. while the files are
+		// being swapped mid-rotation.
+		if r.cert != nil {
+			slog.Warn("Could not reload TLS certificate, keeping previous one", "certFile", r.certFile, "keyFile", r.keyFile, "error", err)
+			r.loaded = time.Now()
+			return r.cert, nil
+		}
+		return nil, fmt.Errorf("loading TLS certificate: %w", err)
+	}
+
+	r.cert = &cert
+	r.loaded = time.Now()
+	return r.cert, nil
+}
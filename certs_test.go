@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequireClientCert(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.ClientCAFile = "/etc/webhook/client-ca.crt"
+	wh := newTestWebhook(t, cfg, &fakeLabelSource{})
+	handler := wh.requireClientCert(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	tests := []struct {
+		name string
+		tls  *tls.ConnectionState
+		want int
+	}{
+		{"plain HTTP", nil, http.StatusUnauthorized},
+		{"no client certificate", &tls.ConnectionState{}, http.StatusUnauthorized},
+		{"verified client certificate", &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}}, http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/mutate", nil)
+			r.TLS = tt.tls
+			w := httptest.NewRecorder()
+			handler(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+// testCert is a certificate and key generated for a test.
+type testCert struct {
+	cert              *x509.Certificate
+	key               *ecdsa.PrivateKey
+	certFile, keyFile string
+}
+
+// newTestCert generates a certificate for commonName, signed by parent or
+// self-signed when parent is nil, and writes it and its key as PEM files
+// <name>.crt and <name>.key in dir. A CA certificate is made when isCA is
+// set.
+func newTestCert(t *testing.T, dir, name, commonName string, isCA bool, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		DNSNames:              []string{commonName},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tc := &testCert{
+		cert:     cert,
+		key:      key,
+		certFile: filepath.Join(dir, name+".crt"),
+		keyFile:  filepath.Join(dir, name+".key"),
+	}
+	if err := os.WriteFile(tc.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tc.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return tc
+}
+
+// startTLSServer serves handler over TLS configured by serverTLSConfig(cfg)
+// and returns its URL.
+func startTLSServer(t *testing.T, cfg Config, handler http.Handler) string {
+	t.Helper()
+	tlsConfig, err := serverTLSConfig(cfg)
+	if err != nil {
+		t.Fatalf("serverTLSConfig: %v", err)
+	}
+	server := httptest.NewUnstartedServer(handler)
+	server.TLS = tlsConfig
+	// StartTLS fills an empty Certificates with httptest's own certificate,
+	// which crypto/tls prefers over GetCertificate unless the client sends
+	// SNI, so clients must set ServerName as the API server does.
+	// Refused handshakes are expected; keep them out of the test output.
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func TestServerTLSConfigMinVersion(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, dir, "ca", "test CA", true, nil)
+	serving := newTestCert(t, dir, "tls", "localhost", false, ca)
+	cfg := testConfig(t)
+	cfg.TLSCertFile, cfg.TLSKeyFile = serving.certFile, serving.keyFile
+	url := startTLSServer(t, cfg, http.HandlerFunc(serveHealthz))
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	get := func(version uint16) error {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:    roots,
+			ServerName: "localhost",
+			MinVersion: version,
+			MaxVersion: version,
+		}}}
+		resp, err := client.Get(url + "/healthz")
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	if err := get(tls.VersionTLS11); err == nil || !strings.Contains(err.Error(), "protocol version") {
+		t.Errorf("TLS 1.1 handshake error = %v, want a protocol version alert", err)
+	}
+	if err := get(tls.VersionTLS12); err != nil {
+		t.Errorf("TLS 1.2 handshake: %v", err)
+	}
+}
+
+func TestRequireClientCertHandshake(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, dir, "ca", "test CA", true, nil)
+	serving := newTestCert(t, dir, "tls", "localhost", false, ca)
+	client := newTestCert(t, dir, "client", "kube-apiserver", false, ca)
+	other := newTestCert(t, dir, "other", "other CA", true, nil)
+	stranger := newTestCert(t, dir, "stranger", "kube-apiserver", false, other)
+
+	cfg := testConfig(t)
+	cfg.TLSCertFile, cfg.TLSKeyFile = serving.certFile, serving.keyFile
+	cfg.ClientCAFile = ca.certFile
+	wh := newTestWebhook(t, cfg, &fakeLabelSource{})
+	url := startTLSServer(t, cfg, wh.requireClientCert(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	post := func(clientCert *testCert) (int, error) {
+		tlsConfig := &tls.Config{RootCAs: roots, ServerName: "localhost"}
+		if clientCert != nil {
+			pair, err := tls.LoadX509KeyPair(clientCert.certFile, clientCert.keyFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Send the certificate even if the server's acceptable CAs
+			// exclude its issuer, as Certificates alone would not.
+			tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return &pair, nil
+			}
+		}
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		resp, err := c.Post(url+"/mutate", "application/json", nil)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	if code, err := post(client); err != nil || code != http.StatusNoContent {
+		t.Errorf("CA-signed client certificate: status %d, error %v; want %d", code, err, http.StatusNoContent)
+	}
+	if code, err := post(nil); err != nil || code != http.StatusUnauthorized {
+		t.Errorf("no client certificate: status %d, error %v; want %d", code, err, http.StatusUnauthorized)
+	}
+	if _, err := post(stranger); err == nil {
+		t.Error("client certificate from another CA: handshake succeeded, want it refused")
+	}
+}
+
+func TestFindCertPair(t *testing.T) {
+	dir := t.TempDir()
+	// Sorted first, but a CA bundle with no key.
+	ca := newTestCert(t, dir, "0 ca bundle", "test CA", true, nil)
+	if err := os.Remove(ca.keyFile); err != nil {
+		t.Fatal(err)
+	}
+	// A key that does not match its certificate.
+	mismatched := newTestCert(t, dir, "a.mismatched", "localhost", false, ca)
+	other := newTestCert(t, dir, "other", "localhost", false, ca)
+	if err := os.Rename(other.keyFile, mismatched.keyFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(other.certFile); err != nil {
+		t.Fatal(err)
+	}
+	// A key without the .key extension is not paired.
+	unpaired := newTestCert(t, dir, "b-unpaired", "localhost", false, ca)
+	if err := os.Rename(unpaired.keyFile, unpaired.keyFile+".pem"); err != nil {
+		t.Fatal(err)
+	}
+	want := newTestCert(t, dir, "webhook-server.tls.v2", "localhost", false, ca)
+
+	certFile, keyFile, err := findCertPair(dir)
+	if err != nil {
+		t.Fatalf("findCertPair: %v", err)
+	}
+	if certFile != want.certFile || keyFile != want.keyFile {
+		t.Errorf("findCertPair = %q, %q; want %q, %q", certFile, keyFile, want.certFile, want.keyFile)
+	}
+
+	if _, _, err := findCertPair(t.TempDir()); err == nil {
+		t.Error("findCertPair in an empty directory succeeded, want an error")
+	}
+}
@@ -0,0 +1,713 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// defaultTargetLabelPrefix is used when TARGET_LABEL_PREFIX is unset.
+const defaultTargetLabelPrefix = "rollouts-pod-template-hash"
+
+// defaultShutdownTimeout is used when SHUTDOWN_TIMEOUT is unset.
+const defaultShutdownTimeout = 10 * time.Second
+
+// defaultHandlerTimeout is used when HANDLER_TIMEOUT is unset. It matches the
+// API server's default webhook timeoutSeconds.
+const defaultHandlerTimeout = 10 * time.Second
+
+// defaultForceDenyMessage is used when FORCE_DENY_MESSAGE is unset.
+const defaultForceDenyMessage = "Denied by FORCE_DENY test mode"
+
+// defaultSkipAnnotation is used when SKIP_ANNOTATION is unset.
+const defaultSkipAnnotation = "webhook.example.com/skip"
+
+// Values for INJECT_AS, selecting where fetched key/values are written.
+const (
+	injectAsLabels      = "labels"
+	injectAsAnnotations = "annotations"
+)
+
+// Values for LABEL_SOURCE_TYPE, selecting where labels come from.
+const (
+	labelSourceHTTP      = "http"
+	labelSourceMock      = "mock"
+	labelSourceStatic    = "static"
+	labelSourceConfigMap = "configmap"
+	labelSourceGRPC      = "grpc"
+)
+
+// Values for INVALID_LABEL_POLICY, selecting how fetched entries that are
+// not valid Kubernetes label syntax are handled.
+const (
+	invalidLabelPolicySkip = "skip"
+	invalidLabelPolicyDeny = "deny"
+)
+
+// Values for TARGET_LABEL_MATCH, selecting how pod label keys are compared
+// against the target label prefixes.
+const (
+	targetLabelMatchPrefix = "prefix"
+	targetLabelMatchExact  = "exact"
+	targetLabelMatchRegex  = "regex"
+)
+
+// defaultMaxBodyBytes is used when MAX_BODY_BYTES is unset. It matches the
+// API server's own 3 MiB request limit, which fits any pod spec.
+const defaultMaxBodyBytes = 3 << 20
+
+// defaultMaxPatchBytes is used when MAX_PATCH_BYTES is unset. It leaves
+// room within the API server's 3 MiB request limit for the pod itself.
+const defaultMaxPatchBytes = 1 << 20
+
+// Values for LONG_VALUE_POLICY, selecting how label values over the 63
+// character limit are handled.
+const (
+	longValuePolicySkip     = "skip"
+	longValuePolicyTruncate = "truncate"
+	longValuePolicyDeny     = "deny"
+)
+
+// Default TLS cert/key paths, used when TLS_CERT_FILE or TLS_KEY_FILE is unset.
+const (
+	defaultTLSCertFile = "/tls/tls.crt"
+	defaultTLSKeyFile  = "/tls/tls.key"
+)
+
+// Config holds the webhook's settings.
+type Config struct {
+	// BindAddress is the interface address the server listens on, IPv4 or
+	// IPv6 (e.g. "::1"); empty means all interfaces.
+	BindAddress string
+	// Port is the port the server listens on.
+	Port string
+	// TLSEnabled selects HTTPS; disable only behind a TLS-terminating proxy.
+	TLSEnabled  bool
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSDir, when set, is searched for a *.crt/*.key pair if TLSCertFile
+	// or TLSKeyFile does not exist.
+	TLSDir string
+	// TLSMinVersion is the lowest TLS version accepted, tls.VersionTLS12
+	// unless TLS_MIN_VERSION is "1.3".
+	TLSMinVersion uint16
+	// ClientCAFile, when set, is a CA bundle client certificates must chain
+	// to. The admission endpoints refuse requests without a verified
+	// certificate; probes and metrics scrapes need none.
+	ClientCAFile string
+	// MaxBodyBytes caps the size of admission request bodies.
+	MaxBodyBytes int64
+	// MaxPatchBytes caps the size of generated patches; larger ones are
+	// denied. A non-positive value disables the check.
+	MaxPatchBytes int
+	// CheckCABundle warns at startup if the caBundle of the
+	// MutatingWebhookConfiguration named WebhookConfigName does not verify
+	// the serving certificate.
+	CheckCABundle bool
+	// SelfRegister creates or updates the webhook's
+	// MutatingWebhookConfiguration, named WebhookConfigName, on startup,
+	// pointing at WebhookServiceName in WebhookServiceNamespace (by default
+	// the webhook's own) and trusting SelfRegisterCAFile (by default
+	// TLSCertFile). SelfRegisterCleanup deletes it again on shutdown, which
+	// only suits a single replica: any replica stopping removes it for all.
+	SelfRegister            bool
+	SelfRegisterCleanup     bool
+	SelfRegisterCAFile      string
+	WebhookConfigName       string
+	WebhookServiceName      string
+	WebhookServiceNamespace string
+	WebhookServicePort      int
+	// ShutdownTimeout is the grace period for in-flight requests on shutdown.
+	ShutdownTimeout time.Duration
+	// EnableConfigEndpoint serves this configuration, with secrets masked,
+	// at /config.
+	EnableConfigEndpoint bool
+	// EnablePprof serves net/http/pprof on localhost:PprofPort over plain
+	// HTTP, reachable only from inside the pod (e.g. via kubectl
+	// port-forward).
+	EnablePprof bool
+	PprofPort   string
+	// DrainPort is where /drain is served, on localhost over plain HTTP, so
+	// only a preStop hook inside the pod can drain the webhook.
+	DrainPort string
+	// HandlerTimeout bounds the handling of one admission request, including
+	// label source calls. Keep it within the webhook's timeoutSeconds.
+	HandlerTimeout time.Duration
+
+	// TargetLabelPrefixes selects pods carrying a label key with any of
+	// these prefixes.
+	TargetLabelPrefixes []string
+	// TargetLabelMatch is targetLabelMatchPrefix, targetLabelMatchExact or
+	// targetLabelMatchRegex. In exact mode a label key must equal one of
+	// TargetLabelPrefixes in full; in regex mode it must match
+	// TargetLabelPattern instead.
+	TargetLabelMatch   string
+	TargetLabelPattern *regexp.Regexp
+	// WorkloadKinds are the apps/v1 kinds (Deployment, StatefulSet,
+	// DaemonSet) whose pod templates are mutated when the webhook is
+	// registered for them; pods are always handled.
+	WorkloadKinds []string
+	// HandleOperations are the admission operations (CREATE, UPDATE, ...)
+	// the webhook mutates on; others are admitted unchanged.
+	HandleOperations []string
+	// NamespaceSelector, when set, is a label selector (e.g.
+	// "webhook-inject=true") the pod's namespace must match to be mutated.
+	NamespaceSelector string
+	// NamespaceCacheTTL is how long namespace lookups are cached.
+	NamespaceCacheTTL time.Duration
+	// ExcludedNamespaces are never mutated.
+	ExcludedNamespaces []string
+	// SkipAnnotation lets a pod opt out of mutation by setting it to a true
+	// value.
+	SkipAnnotation string
+	// InjectAs is injectAsLabels or injectAsAnnotations.
+	InjectAs string
+	// InvalidLabelPolicy is invalidLabelPolicySkip or invalidLabelPolicyDeny.
+	InvalidLabelPolicy string
+	// LongValuePolicy is longValuePolicySkip, longValuePolicyTruncate or
+	// longValuePolicyDeny.
+	LongValuePolicy string
+	// FailOpen admits pods unmodified, rather than denying them, when the
+	// label source fails.
+	FailOpen bool
+	// AllowedLabelKeys, when set, restricts which keys from the label source
+	// are applied.
+	AllowedLabelKeys []string
+	// LabelTemplates are labels whose values are Go templates over the pod,
+	// parsed from LABEL_TEMPLATES, e.g. "env={{ .Namespace }}". See
+	// labelTemplateData for the fields available.
+	LabelTemplates map[string]*template.Template
+	// OwnerLabelKeys are copied to matching pods from their controller
+	// (e.g. ReplicaSet) or its controller (e.g. Deployment).
+	OwnerLabelKeys []string
+	// NamespaceAnnotationLabels maps annotation keys of a pod's namespace to
+	// the label keys they are copied to on the pod.
+	NamespaceAnnotationLabels map[string]string
+	// RemoveLabels are label keys stripped from matching pods that carry
+	// them.
+	RemoveLabels []string
+	// StaticLabels are applied to every matching pod, with label source
+	// values taking precedence on key collisions.
+	StaticLabels map[string]string
+	// InjectEnvName, when set, is added to every container of matching pods
+	// with the value InjectEnvValue.
+	InjectEnvName  string
+	InjectEnvValue string
+	// IncludeInitContainers extends env injection to init containers.
+	IncludeInitContainers bool
+	// Sidecar, loaded from SIDECAR_SPEC_FILE, is appended to the containers
+	// of matching pods.
+	Sidecar *corev1.Container
+	// ForceDeny makes every matching pod be denied with ForceDenyMessage,
+	// for testing how clients handle the webhook's failurePolicy. Never
+	// enable it in production.
+	ForceDeny        bool
+	ForceDenyMessage string
+	// StrictDecode denies objects with fields unknown to the webhook's
+	// compiled-in API types instead of silently dropping them. It surfaces
+	// client bugs but also rejects fields added by newer Kubernetes
+	// versions, so it is meant for non-production clusters.
+	StrictDecode bool
+	// PatchSelfCheck applies each generated patch to the pod and logs an
+	// error if the result is not as expected. It is a debugging aid and
+	// costs an extra decode per mutation.
+	PatchSelfCheck bool
+	// MetricsNamespaceLimit caps how many namespaces get their own
+	// namespace label on the admission metrics; the rest share "other".
+	MetricsNamespaceLimit int
+	// EmitEvents records a Kubernetes Event for each mutated pod or workload
+	// that already has a name.
+	EmitEvents bool
+	// ForbiddenLabels are denied by /validate, as keys or key=value pairs.
+	ForbiddenLabels []string
+
+	// DefaultNamespace is sent to the label source for requests without a
+	// namespace.
+	DefaultNamespace string
+	// LabelSourceType selects the LabelSource; see newLabelSource. It
+	// defaults to labelSourceHTTP when LabelAPIURL is set and
+	// labelSourceMock otherwise, and is forced to labelSourceStatic by
+	// DISABLE_LABEL_API.
+	LabelSourceType string
+	// LabelOverridesConfigMap, when set, names a ConfigMap in
+	// LabelOverridesNamespace (by default the webhook's own) holding
+	// per-namespace labels that take precedence over the label source.
+	LabelOverridesConfigMap string
+	LabelOverridesNamespace string
+
+	// LabelAPIURL is the label service endpoint of the http label source.
+	LabelAPIURL string
+	// LabelGRPCAddr is the label service address of the grpc label source,
+	// dialled with TLS when LabelGRPCTLS is set. The timeout, breaker, rate
+	// limit and cache settings of the label API apply to it too.
+	LabelGRPCAddr string
+	LabelGRPCTLS  bool
+	// MockLabels replace the built-in demo labels returned when there is no
+	// label API.
+	MockLabels map[string]string
+	// LabelAPIToken is sent as a bearer token. LabelAPITokenFile, if set,
+	// takes precedence and is re-read on every request so rotated tokens
+	// are picked up.
+	LabelAPIToken     string
+	LabelAPITokenFile string
+	LabelAPITimeout   time.Duration
+	// LabelAPIRetries is the total number of attempts per label fetch.
+	LabelAPIRetries int
+	// LabelAPIBreakerThreshold consecutive failed fetches open the circuit
+	// for LabelAPIBreakerCooldown, during which fetches fail immediately.
+	// A non-positive threshold disables the breaker.
+	LabelAPIBreakerThreshold int
+	LabelAPIBreakerCooldown  time.Duration
+	// LabelAPIRPS, when positive, caps label API calls per second, with
+	// bursts of up to LabelAPIBurst (by default LabelAPIRPS).
+	LabelAPIRPS   int
+	LabelAPIBurst int
+	LabelCacheTTL time.Duration
+
+	// TracingEndpoint, when set, is the OTLP/gRPC endpoint spans are
+	// exported to; see setupTracing.
+	TracingEndpoint string
+}
+
+// loadConfig builds the Config from environment variables and the config
+// file loaded by loadFileSettings, applying defaults for anything unset.
+// Environment variables override the file. An invalid value is fatal.
+func loadConfig() Config {
+	cfg := Config{
+		BindAddress:        getenv("BIND_ADDRESS"),
+		Port:               getenv("PORT"),
+		TLSEnabled:         boolFromEnv("TLS_ENABLED", true),
+		TLSCertFile:        getenv("TLS_CERT_FILE"),
+		TLSKeyFile:         getenv("TLS_KEY_FILE"),
+		TLSDir:             getenv("TLS_DIR"),
+		ClientCAFile:       getenv("CLIENT_CA_FILE"),
+		MaxBodyBytes:       int64(intFromEnv("MAX_BODY_BYTES", defaultMaxBodyBytes)),
+		MaxPatchBytes:      intFromEnv("MAX_PATCH_BYTES", defaultMaxPatchBytes),
+		ShutdownTimeout:    durationFromEnv("SHUTDOWN_TIMEOUT", defaultShutdownTimeout),
+		HandlerTimeout:     durationFromEnv("HANDLER_TIMEOUT", defaultHandlerTimeout),
+		EnablePprof:        boolFromEnv("ENABLE_PPROF", false),
+		PprofPort:          getenv("PPROF_PORT"),
+		DrainPort:          getenv("DRAIN_PORT"),
+		TargetLabelMatch:   getenv("TARGET_LABEL_MATCH"),
+		HandleOperations:   splitList(strings.ToUpper(getenv("HANDLE_OPERATIONS"))),
+		WorkloadKinds:      splitList(getenv("WORKLOAD_KINDS")),
+		NamespaceSelector:  getenv("NAMESPACE_SELECTOR"),
+		NamespaceCacheTTL:  durationFromEnv("NAMESPACE_CACHE_TTL", defaultNamespaceCacheTTL),
+		ExcludedNamespaces: splitList(getenv("EXCLUDED_NAMESPACES")),
+		SkipAnnotation:     getenv("SKIP_ANNOTATION"),
+		InjectAs:           getenv("INJECT_AS"),
+		InvalidLabelPolicy: getenv("INVALID_LABEL_POLICY"),
+		LongValuePolicy:    getenv("LONG_VALUE_POLICY"),
+		FailOpen:           boolFromEnv("FAIL_OPEN", false),
+		AllowedLabelKeys:   splitList(getenv("ALLOWED_LABEL_KEYS")),
+		RemoveLabels:       splitList(getenv("REMOVE_LABELS")),
+		OwnerLabelKeys:     splitList(getenv("OWNER_LABEL_KEYS")),
+		InjectEnvName:      getenv("INJECT_ENV_NAME"),
+		InjectEnvValue:     getenv("INJECT_ENV_VALUE"),
+		EmitEvents:         boolFromEnv("EMIT_EVENTS", false),
+		PatchSelfCheck:     boolFromEnv("PATCH_SELFCHECK", false),
+		StrictDecode:       boolFromEnv("STRICT_DECODE", false),
+		ForceDeny:          boolFromEnv("FORCE_DENY", false),
+		ForceDenyMessage:   getenv("FORCE_DENY_MESSAGE"),
+		ForbiddenLabels:    splitList(getenv("FORBIDDEN_LABELS")),
+		LabelAPIURL:        getenv("LABEL_API_URL"),
+		LabelAPIToken:      getenv("LABEL_API_TOKEN"),
+		LabelAPITokenFile:  getenv("LABEL_API_TOKEN_FILE"),
+		LabelAPITimeout:    durationFromEnv("LABEL_API_TIMEOUT", defaultLabelAPITimeout),
+		LabelAPIRetries:    intFromEnv("LABEL_API_RETRIES", defaultLabelAPIRetries),
+		LabelCacheTTL:      durationFromEnv("LABEL_CACHE_TTL", defaultLabelCacheTTL),
+
+		MetricsNamespaceLimit:    intFromEnv("METRICS_NAMESPACE_LIMIT", defaultMetricsNamespaceLimit),
+		IncludeInitContainers:    boolFromEnv("INCLUDE_INIT_CONTAINERS", false),
+		SelfRegister:             boolFromEnv("SELF_REGISTER", false),
+		CheckCABundle:            boolFromEnv("CHECK_CA_BUNDLE", false),
+		EnableConfigEndpoint:     boolFromEnv("ENABLE_CONFIG_ENDPOINT", false),
+		SelfRegisterCleanup:      boolFromEnv("SELF_REGISTER_CLEANUP", false),
+		SelfRegisterCAFile:       getenv("SELF_REGISTER_CA_FILE"),
+		WebhookConfigName:        getenv("SELF_REGISTER_NAME"),
+		WebhookServiceName:       getenv("SELF_REGISTER_SERVICE_NAME"),
+		WebhookServiceNamespace:  getenv("SELF_REGISTER_SERVICE_NAMESPACE"),
+		WebhookServicePort:       intFromEnv("SELF_REGISTER_SERVICE_PORT", defaultWebhookServicePort),
+		DefaultNamespace:         getenv("DEFAULT_NAMESPACE"),
+		LabelSourceType:          getenv("LABEL_SOURCE_TYPE"),
+		LabelOverridesConfigMap:  getenv("LABEL_OVERRIDES_CONFIGMAP"),
+		LabelOverridesNamespace:  getenv("LABEL_OVERRIDES_NAMESPACE"),
+		LabelAPIBreakerThreshold: intFromEnv("LABEL_API_BREAKER_THRESHOLD", defaultLabelAPIBreakerThreshold),
+		LabelAPIBreakerCooldown:  durationFromEnv("LABEL_API_BREAKER_COOLDOWN", defaultLabelAPIBreakerCooldown),
+		LabelAPIRPS:              intFromEnv("LABEL_API_RPS", 0),
+		LabelAPIBurst:            intFromEnv("LABEL_API_BURST", 0),
+		LabelGRPCAddr:            getenv("LABEL_GRPC_ADDR"),
+		LabelGRPCTLS:             boolFromEnv("LABEL_GRPC_TLS", false),
+		TracingEndpoint:          getenv("OTEL_EXPORTER_OTLP_ENDPOINT"),
+	}
+	if cfg.Port == "" {
+		cfg.Port = "8443"
+	}
+	if cfg.PprofPort == "" {
+		cfg.PprofPort = defaultPprofPort
+	}
+	if cfg.DrainPort == "" {
+		cfg.DrainPort = defaultDrainPort
+	}
+	// TLS cert/key are mounted at /tls/tls.crt and /tls/tls.key by default.
+	if cfg.TLSCertFile == "" {
+		cfg.TLSCertFile = defaultTLSCertFile
+	}
+	if cfg.TLSKeyFile == "" {
+		cfg.TLSKeyFile = defaultTLSKeyFile
+	}
+	cfg.TLSMinVersion = tls.VersionTLS12
+	if value := getenv("TLS_MIN_VERSION"); value != "" {
+		version, err := parseTLSVersion(value)
+		if err != nil {
+			fatal("Invalid environment variable", "name", "TLS_MIN_VERSION", "error", err)
+		}
+		cfg.TLSMinVersion = version
+	}
+	// A non-positive limit would reject every admission request.
+	if cfg.MaxBodyBytes <= 0 {
+		fatal("MAX_BODY_BYTES must be positive", "value", cfg.MaxBodyBytes)
+	}
+	if cfg.HandlerTimeout <= 0 {
+		fatal("HANDLER_TIMEOUT must be positive", "value", cfg.HandlerTimeout)
+	}
+	// Without TLS there are no client certificates, so every admission
+	// request would be refused.
+	if cfg.ClientCAFile != "" && !cfg.TLSEnabled {
+		fatal("CLIENT_CA_FILE requires TLS_ENABLED", "clientCAFile", cfg.ClientCAFile)
+	}
+	if cfg.DefaultNamespace == "" {
+		cfg.DefaultNamespace = metav1.NamespaceDefault
+	}
+	if cfg.WebhookConfigName == "" {
+		cfg.WebhookConfigName = defaultWebhookConfigName
+	}
+	if cfg.WebhookServiceName == "" {
+		cfg.WebhookServiceName = defaultWebhookServiceName
+	}
+	if len(cfg.HandleOperations) == 0 {
+		cfg.HandleOperations = []string{string(admissionv1.Create)}
+	}
+	if cfg.ForceDenyMessage == "" {
+		cfg.ForceDenyMessage = defaultForceDenyMessage
+	}
+	if cfg.SkipAnnotation == "" {
+		cfg.SkipAnnotation = defaultSkipAnnotation
+	}
+	for _, kind := range cfg.WorkloadKinds {
+		if !slices.Contains(supportedWorkloadKinds, kind) {
+			fatal("Invalid environment variable", "name", "WORKLOAD_KINDS", "value", kind, "supported", supportedWorkloadKinds)
+		}
+	}
+	pattern := getenv("TARGET_LABEL_PATTERN")
+	switch cfg.TargetLabelMatch {
+	case "":
+		cfg.TargetLabelMatch = targetLabelMatchPrefix
+	case targetLabelMatchPrefix, targetLabelMatchExact:
+	case targetLabelMatchRegex:
+		if pattern == "" {
+			fatal("TARGET_LABEL_PATTERN is required when TARGET_LABEL_MATCH is regex")
+		}
+		// Compiled once here so a bad pattern fails at startup.
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			fatal("Invalid environment variable", "name", "TARGET_LABEL_PATTERN", "value", pattern, "error", err)
+		}
+		cfg.TargetLabelPattern = re
+	default:
+		fatal("Invalid environment variable", "name", "TARGET_LABEL_MATCH", "value", cfg.TargetLabelMatch)
+	}
+	// DISABLE_LABEL_API guarantees no outbound label API calls, whatever
+	// else is configured.
+	if boolFromEnv("DISABLE_LABEL_API", false) {
+		if cfg.LabelSourceType != "" && cfg.LabelSourceType != labelSourceStatic {
+			fatal("LABEL_SOURCE_TYPE conflicts with DISABLE_LABEL_API", "labelSourceType", cfg.LabelSourceType)
+		}
+		cfg.LabelSourceType = labelSourceStatic
+	}
+	switch cfg.LabelSourceType {
+	case "":
+		cfg.LabelSourceType = labelSourceMock
+		if cfg.LabelAPIURL != "" {
+			cfg.LabelSourceType = labelSourceHTTP
+		}
+	case labelSourceHTTP:
+		if cfg.LabelAPIURL == "" {
+			fatal("LABEL_API_URL is required when LABEL_SOURCE_TYPE is http")
+		}
+	case labelSourceGRPC:
+		if cfg.LabelGRPCAddr == "" {
+			fatal("LABEL_GRPC_ADDR is required when LABEL_SOURCE_TYPE is grpc")
+		}
+	case labelSourceConfigMap:
+		if cfg.LabelOverridesConfigMap == "" {
+			fatal("LABEL_OVERRIDES_CONFIGMAP is required when LABEL_SOURCE_TYPE is configmap")
+		}
+	case labelSourceMock, labelSourceStatic:
+	default:
+		fatal("Invalid environment variable", "name", "LABEL_SOURCE_TYPE", "value", cfg.LabelSourceType)
+	}
+	switch cfg.InjectAs {
+	case "":
+		cfg.InjectAs = injectAsLabels
+	case injectAsLabels, injectAsAnnotations:
+	default:
+		fatal("Invalid environment variable", "name", "INJECT_AS", "value", cfg.InjectAs)
+	}
+	switch cfg.InvalidLabelPolicy {
+	case "":
+		cfg.InvalidLabelPolicy = invalidLabelPolicySkip
+	case invalidLabelPolicySkip, invalidLabelPolicyDeny:
+	default:
+		fatal("Invalid environment variable", "name", "INVALID_LABEL_POLICY", "value", cfg.InvalidLabelPolicy)
+	}
+	switch cfg.LongValuePolicy {
+	case "":
+		cfg.LongValuePolicy = longValuePolicySkip
+	case longValuePolicySkip, longValuePolicyTruncate, longValuePolicyDeny:
+	default:
+		fatal("Invalid environment variable", "name", "LONG_VALUE_POLICY", "value", cfg.LongValuePolicy)
+	}
+
+	staticLabels, err := parseKeyValueList(getenv("STATIC_LABELS"))
+	if err != nil {
+		fatal("Invalid environment variable", "name", "STATIC_LABELS", "error", err)
+	}
+	cfg.StaticLabels = staticLabels
+
+	// Templates are compiled here so a bad one fails at startup. Their
+	// source cannot contain commas.
+	templateSources, err := parseKeyValueList(getenv("LABEL_TEMPLATES"))
+	if err != nil {
+		fatal("Invalid environment variable", "name", "LABEL_TEMPLATES", "error", err)
+	}
+	cfg.LabelTemplates, err = parseLabelTemplates(templateSources)
+	if err != nil {
+		fatal("Invalid environment variable", "name", "LABEL_TEMPLATES", "error", err)
+	}
+
+	cfg.NamespaceAnnotationLabels, err = parseNamespaceAnnotationLabels(getenv("NAMESPACE_ANNOTATION_LABELS"))
+	if err != nil {
+		fatal("Invalid environment variable", "name", "NAMESPACE_ANNOTATION_LABELS", "error", err)
+	}
+
+	mockLabels, err := parseKeyValueList(getenv("MOCK_LABELS"))
+	if err != nil {
+		fatal("Invalid environment variable", "name", "MOCK_LABELS", "error", err)
+	}
+	cfg.MockLabels = mockLabels
+	if len(cfg.MockLabels) == 0 {
+		cfg.MockLabels = defaultMockLabels
+	}
+
+	if path := getenv("SIDECAR_SPEC_FILE"); path != "" {
+		sidecar, err := loadSidecarSpec(path)
+		if err != nil {
+			fatal("Error loading sidecar spec", "path", path, "error", err)
+		}
+		cfg.Sidecar = sidecar
+	}
+
+	// TARGET_LABEL_PREFIXES takes precedence over the single TARGET_LABEL_PREFIX.
+	cfg.TargetLabelPrefixes = splitList(getenv("TARGET_LABEL_PREFIXES"))
+	targetPrefix := getenv("TARGET_LABEL_PREFIX")
+	if len(cfg.TargetLabelPrefixes) == 0 {
+		if targetPrefix == "" {
+			targetPrefix = defaultTargetLabelPrefix
+		}
+		cfg.TargetLabelPrefixes = []string{targetPrefix}
+	}
+	return cfg
+}
+
+// fileSettings holds the settings read from CONFIG_FILE, keyed by
+// environment variable name.
+var fileSettings map[string]string
+
+// knownSettings records the name of every setting looked up with getenv, so
+// config file keys nothing reads can be reported.
+var knownSettings = make(map[string]bool)
+
+// loadFileSettings reads the YAML file named by CONFIG_FILE, if set, into
+// fileSettings. It must run before any setting is read, logging's included.
+func loadFileSettings() {
+	path := os.Getenv("CONFIG_FILE")
+	if path == "" {
+		return
+	}
+	settings, err := loadConfigFile(path)
+	if err != nil {
+		fatal("Error loading config file", "path", path, "error", err)
+	}
+	fileSettings = settings
+}
+
+// warnUnknownSettings logs the config file keys no setting lookup used,
+// typically misspellings. It must run after every setting has been read.
+func warnUnknownSettings() {
+	for _, name := range sortedKeys(fileSettings) {
+		if !knownSettings[name] {
+			slog.Warn("Ignoring unknown setting in config file", "name", name)
+		}
+	}
+}
+
+// getenv returns the named setting: the environment variable if it is set,
+// otherwise the value from the config file, if any.
+func getenv(name string) string {
+	knownSettings[name] = true
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fileSettings[name]
+}
+
+// loadConfigFile reads a YAML mapping of settings from path. Keys are the
+// environment variable names, e.g.
+//
+//	LABEL_API_URL: https://labels.example.com
+//	LABEL_API_TIMEOUT: 2s
+//	EXCLUDED_NAMESPACES: [kube-system, monitoring]
+//	STATIC_LABELS: {team: platform}
+//
+// Lists and maps are flattened to the comma-separated forms the environment
+// variables take.
+func loadConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file: %w", err)
+	}
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("parsing config file: %w", err)
+	}
+
+	settings := make(map[string]string, len(raw))
+	for name, value := range raw {
+		s, err := settingString(value)
+		if err != nil {
+			return nil, fmt.Errorf("setting %s: %w", name, err)
+		}
+		settings[name] = s
+	}
+	return settings, nil
+}
+
+// settingString renders a decoded YAML value in environment variable form.
+func settingString(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			s, err := settingString(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	case map[string]interface{}:
+		pairs := make([]string, 0, len(v))
+		for key, item := range v {
+			s, err := settingString(item)
+			if err != nil {
+				return "", err
+			}
+			pairs = append(pairs, key+"="+s)
+		}
+		sort.Strings(pairs)
+		return strings.Join(pairs, ","), nil
+	default:
+		return "", fmt.Errorf("unsupported value %v", value)
+	}
+}
+
+// splitList splits a comma-separated list, trimming whitespace and skipping
+// empty entries.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseKeyValueList parses a comma-separated list of key=value pairs. Keys
+// must be non-empty; values may be empty.
+func parseKeyValueList(s string) (map[string]string, error) {
+	pairs := make(map[string]string)
+	for _, item := range splitList(s) {
+		key, value, ok := strings.Cut(item, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("malformed entry %q, want key=value", item)
+		}
+		pairs[key] = strings.TrimSpace(value)
+	}
+	return pairs, nil
+}
+
+// durationFromEnv parses the named environment variable as a time.Duration,
+// returning def when it is unset. An invalid value is fatal.
+func durationFromEnv(name string, def time.Duration) time.Duration {
+	value := getenv(name)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		fatal("Invalid environment variable", "name", name, "value", value, "error", err)
+	}
+	return d
+}
+
+// intFromEnv parses the named environment variable as an int, returning def
+// when it is unset. An invalid value is fatal.
+func intFromEnv(name string, def int) int {
+	value := getenv(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		fatal("Invalid environment variable", "name", name, "value", value, "error", err)
+	}
+	return n
+}
+
+// boolFromEnv parses the named environment variable as a bool, returning def
+// when it is unset. An invalid value is fatal.
+func boolFromEnv(name string, def bool) bool {
+	value := getenv(name)
+	if value == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		fatal("Invalid environment variable", "name", name, "value", value, "error", err)
+	}
+	return b
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestConfigFileSettings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	file := "LOG_LEVEL: debug\nEXCLUDED_NAMESPACES: [kube-system, monitoring]\nEXCLUDED_NAMESPACE: typo\n"
+	if err := os.WriteFile(path, []byte(file), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", path)
+	defer func(logger *slog.Logger) {
+		slog.SetDefault(logger)
+		fileSettings = nil
+	}(slog.Default())
+
+	loadFileSettings()
+	setupLogging()
+	if !slog.Default().Enabled(t.Context(), slog.LevelDebug) {
+		t.Error("LOG_LEVEL from the config file was not applied")
+	}
+	cfg := loadConfig()
+	if got := strings.Join(cfg.ExcludedNamespaces, ","); got != "kube-system,monitoring" {
+		t.Errorf("ExcludedNamespaces = %q, want %q", got, "kube-system,monitoring")
+	}
+
+	var logs bytes.Buffer
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+	warnUnknownSettings()
+	if !strings.Contains(logs.String(), "name=EXCLUDED_NAMESPACE\n") {
+		t.Errorf("no warning for the unknown EXCLUDED_NAMESPACE setting in %q", logs.String())
+	}
+	if strings.Contains(logs.String(), "LOG_LEVEL") || strings.Contains(logs.String(), "EXCLUDED_NAMESPACES") {
+		t.Errorf("known settings reported as unknown: %q", logs.String())
+	}
+}
+
+func TestParseKeyValueList(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    map[string]string
+		wantErr bool
+	}{
+		{in: "", want: map[string]string{}},
+		{in: "team=platform, tier = backend", want: map[string]string{"team": "platform", "tier": "backend"}},
+		{in: "empty=", want: map[string]string{"empty": ""}},
+		{in: "team", wantErr: true},
+		{in: "team=platform,=backend", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseKeyValueList(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parseKeyValueList(%q) = %v, want an error", tt.in, got)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseKeyValueList(%q) = %v, %v; want %v", tt.in, got, err, tt.want)
+			}
+		})
+	}
+}
+
+// loadConfigExitEnv is set in the subprocesses run by loadConfigFails.
+const loadConfigExitEnv = "WEBHOOK_TEST_LOAD_CONFIG"
+
+// TestLoadConfigSubprocess loads the configuration when run by
+// loadConfigFails; invalid settings make it exit instead of returning.
+func TestLoadConfigSubprocess(t *testing.T) {
+	if os.Getenv(loadConfigExitEnv) == "" {
+		t.Skip("only run by loadConfigFails")
+	}
+	loadConfig()
+}
+
+// loadConfigFails reports whether loadConfig exits with env set, returning
+// the subprocess's output.
+func loadConfigFails(t *testing.T, env ...string) (bool, string) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestLoadConfigSubprocess$")
+	cmd.Env = append(os.Environ(), append(env, loadConfigExitEnv+"=1")...)
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		t.Fatalf("running subprocess: %v", err)
+	}
+	return err != nil, string(out)
+}
+
+func TestLoadConfigMaxBodyBytes(t *testing.T) {
+	for _, value := range []string{"0", "-1"} {
+		if failed, out := loadConfigFails(t, "MAX_BODY_BYTES="+value); !failed || !strings.Contains(out, "MAX_BODY_BYTES") {
+			t.Errorf("MAX_BODY_BYTES=%s: failed %v, output %q; want a fatal error naming it", value, failed, out)
+		}
+	}
+	if failed, out := loadConfigFails(t, "MAX_BODY_BYTES=1024"); failed {
+		t.Errorf("MAX_BODY_BYTES=1024 failed: %s", out)
+	}
+}
+
+func TestLoadConfigHandlerTimeout(t *testing.T) {
+	for _, value := range []string{"0s", "-1s"} {
+		if failed, out := loadConfigFails(t, "HANDLER_TIMEOUT="+value); !failed || !strings.Contains(out, "HANDLER_TIMEOUT") {
+			t.Errorf("HANDLER_TIMEOUT=%s: failed %v, output %q; want a fatal error naming it", value, failed, out)
+		}
+	}
+}
+
+func TestLoadConfigClientCAWithoutTLS(t *testing.T) {
+	if failed, out := loadConfigFails(t, "CLIENT_CA_FILE=/etc/webhook/client-ca.crt", "TLS_ENABLED=false"); !failed || !strings.Contains(out, "CLIENT_CA_FILE") {
+		t.Errorf("failed %v, output %q; want a fatal error naming CLIENT_CA_FILE", failed, out)
+	}
+}
+
+func TestLoadConfigTargetLabelPattern(t *testing.T) {
+	if failed, out := loadConfigFails(t, "TARGET_LABEL_MATCH=regex", "TARGET_LABEL_PATTERN=canary.(track"); !failed || !strings.Contains(out, "TARGET_LABEL_PATTERN") {
+		t.Errorf("bad pattern: failed %v, output %q; want a fatal error naming TARGET_LABEL_PATTERN", failed, out)
+	}
+	if failed, out := loadConfigFails(t, "TARGET_LABEL_MATCH=regex"); !failed || !strings.Contains(out, "TARGET_LABEL_PATTERN") {
+		t.Errorf("missing pattern: failed %v, output %q; want a fatal error naming TARGET_LABEL_PATTERN", failed, out)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"slices"
+	"text/template"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// redactedConfigFields are the Config fields /config masks.
+var redactedConfigFields = []string{"LabelAPIToken", "InjectEnvValue"}
+
+// urlConfigFields are the Config fields holding URLs, whose passwords
+// /config masks.
+var urlConfigFields = []string{"LabelAPIURL", "TracingEndpoint"}
+
+// redactedValue replaces secrets in /config output.
+const redactedValue = "REDACTED"
+
+// configView renders cfg for display: secrets, URL passwords and the
+// sidecar's env values are masked, durations are written as strings like
+// "30s", and compiled patterns and templates as their source.
+func configView(cfg Config) map[string]interface{} {
+	view := make(map[string]interface{})
+	value := reflect.ValueOf(cfg)
+	for i := 0; i < value.NumField(); i++ {
+		name := value.Type().Field(i).Name
+		switch field := value.Field(i).Interface().(type) {
+		case string:
+			switch {
+			case field != "" && slices.Contains(redactedConfigFields, name):
+				view[name] = redactedValue
+			case slices.Contains(urlConfigFields, name):
+				view[name] = redactURL(field)
+			default:
+				view[name] = field
+			}
+		case *corev1.Container:
+			view[name] = redactContainerEnv(field)
+		case time.Duration:
+			view[name] = field.String()
+		case *regexp.Regexp:
+			if field != nil {
+				view[name] = field.String()
+			} else {
+				view[name] = nil
+			}
+		case map[string]*template.Template:
+			sources := make(map[string]string, len(field))
+			for key, tmpl := range field {
+				sources[key] = tmpl.Root.String()
+			}
+			view[name] = sources
+		default:
+			view[name] = field
+		}
+	}
+	return view
+}
+
+// ServeConfig reports the effective configuration as JSON, with secrets
+// masked, or YAML on request.
+func (wh *Webhook) ServeConfig(w http.ResponseWriter, r *http.Request) {
+	body, err := json.Marshal(configView(wh.config))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "Could not marshal config: "+err.Error())
+		return
+	}
+	writeNegotiated(w, r, "application/json", body)
+}
+
+// redactURL masks the password in a URL. Values that do not parse are
+// masked entirely, as they may still hold credentials.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return redactedValue
+	}
+	return u.Redacted()
+}
+
+// redactContainerEnv returns a copy of container with its literal env values
+// masked.
+func redactContainerEnv(container *corev1.Container) *corev1.Container {
+	if container == nil {
+		return nil
+	}
+	redacted := container.DeepCopy()
+	for i := range redacted.Env {
+		if redacted.Env[i].Value != "" {
+			redacted.Env[i].Value = redactedValue
+		}
+	}
+	return redacted
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// sidecarInjectedAnnotation marks pods that already received the sidecar, so
+// reinvocations do not inject it twice.
+const sidecarInjectedAnnotation = "webhook.example.com/sidecar-injected"
+
+// loadSidecarSpec reads a container spec, as YAML or JSON, from path.
+func loadSidecarSpec(path string) (*corev1.Container, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading sidecar spec: %w", err)
+	}
+	var sidecar corev1.Container
+	if err := yaml.Unmarshal(data, &sidecar); err != nil {
+		return nil, fmt.Errorf("parsing sidecar spec: %w", err)
+	}
+	if sidecar.Name == "" {
+		return nil, fmt.Errorf("sidecar spec %s has no container name", path)
+	}
+	return &sidecar, nil
+}
+
+// needsSidecar reports whether the sidecar should be injected into pod: it is
+// neither marked as injected nor already running a container of that name.
+func needsSidecar(pod *corev1.Pod, sidecar *corev1.Container) bool {
+	if _, marked := pod.Annotations[sidecarInjectedAnnotation]; marked {
+		return false
+	}
+	for _, container := range pod.Spec.Containers {
+		if container.Name == sidecar.Name {
+			return false
+		}
+	}
+	return true
+}
+
+// containerEnvPatches returns JSON patch ops appending env to each container
+// at basePath (e.g. "/spec/containers"). Containers that already define a
+// variable with the same name are left alone so their own setting wins.
+func containerEnvPatches(containers []corev1.Container, basePath string, env corev1.EnvVar) []map[string]interface{} {
+	var patches []map[string]interface{}
+	for i, container := range containers {
+		if hasEnvVar(container.Env, env.Name) {
+			continue
+		}
+
+		path := basePath + "/" + strconv.Itoa(i) + "/env"
+		if container.Env == nil {
+			// There is no array to append to yet, so create it.
+			patches = append(patches, map[string]interface{}{
+				"op":    "add",
+				"path":  path,
+				"value": []corev1.EnvVar{env},
+			})
+			continue
+		}
+		patches = append(patches, map[string]interface{}{
+			"op":    "add",
+			"path":  path + "/-",
+			"value": env,
+		})
+	}
+	return patches
+}
+
+// withEnvVar returns container with env appended, copying it rather than
+// modifying the original. A container already defining the variable is
+// returned as is.
+func withEnvVar(container *corev1.Container, env corev1.EnvVar) *corev1.Container {
+	if hasEnvVar(container.Env, env.Name) {
+		return container
+	}
+	container = container.DeepCopy()
+	container.Env = append(container.Env, env)
+	return container
+}
+
+// hasEnvVar reports whether env defines a variable called name.
+func hasEnvVar(env []corev1.EnvVar, name string) bool {
+	for _, e := range env {
+		if e.Name == name {
+			return true
+		}
+	}
+	return false
+}
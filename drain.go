@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+)
+
+// defaultDrainPort is used when DRAIN_PORT is unset.
+const defaultDrainPort = "8081"
+
+// ServeDrain marks the webhook as draining, so /readyz fails and traffic is
+// routed away before shutdown. Admission requests are still served. It is
+// irreversible short of a restart.
+func (wh *Webhook) ServeDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed, use POST")
+		return
+	}
+	if !wh.draining.Swap(true) {
+		wh.logger.Info("Draining: readiness will now fail")
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("draining"))
+}
+
+// newDrainServer returns a server for /drain on localhost:port. It is kept
+// off the admission server, which anything that can reach the Service could
+// use to take every replica out of rotation.
+func (wh *Webhook) newDrainServer(port string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/drain", wh.ServeDrain)
+	return &http.Server{Addr: net.JoinHostPort("localhost", port), Handler: mux}
+}
+
+// startDrainServer serves /drain on localhost:port in the background, for a
+// preStop hook such as "curl -X POST localhost:8081/drain".
+func (wh *Webhook) startDrainServer(port string) {
+	server := wh.newDrainServer(port)
+	go func() {
+		slog.Info("Starting drain server", "addr", server.Addr)
+		// Admission works without it; pods just leave rotation on shutdown
+		// instead of ahead of it.
+		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Drain server stopped", "error", err)
+		}
+	}()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// eventTimeout bounds the asynchronous Event creation after a mutation.
+const eventTimeout = 5 * time.Second
+
+// eventComponent is reported as the source of Events created by the webhook.
+const eventComponent = "label-webhook"
+
+// emitMutationEvent records a Kubernetes Event on the mutated object, a pod or
+// workload of the given kind, listing the applied labels. It runs in the
+// background so admission is never slowed or failed by it; errors are only
+// logged.
+func (wh *Webhook) emitMutationEvent(kind metav1.GroupVersionKind, namespace, name string, applied map[string]string) {
+	pairs := make([]string, 0, len(applied))
+	for key, value := range applied {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+
+	now := metav1.NewTime(time.Now())
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: eventComponent + "-",
+			Namespace:    namespace,
+		},
+		InvolvedObject: corev1.ObjectReference{
+			Kind:       kind.Kind,
+			APIVersion: schema.GroupVersion{Group: kind.Group, Version: kind.Version}.String(),
+			Namespace:  namespace,
+			Name:       name,
+		},
+		Reason:         "LabelsInjected",
+		Message:        "Applied labels: " + strings.Join(pairs, ", "),
+		Type:           corev1.EventTypeNormal,
+		Source:         corev1.EventSource{Component: eventComponent},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), eventTimeout)
+		defer cancel()
+		if _, err := wh.client.CoreV1().Events(namespace).Create(ctx, event, metav1.CreateOptions{}); err != nil {
+			wh.logger.Warn("Could not create mutation event", "namespace", namespace, "kind", kind.Kind, "name", name, "error", err)
+		}
+	}()
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+
+	labelsv1 "github.com/david-serrano-realtor/webhookPOC/proto/labels/v1"
+)
+
+// grpcLabelSource fetches labels from the label service defined in
+// proto/labels/v1/labels.proto. A single connection is shared by all
+// fetches.
+type grpcLabelSource struct {
+	conn    *grpc.ClientConn
+	client  labelsv1.LabelServiceClient
+	timeout time.Duration
+}
+
+// newGRPCLabelSource connects to the gRPC label service at cfg.LabelGRPCAddr.
+// The connection is established lazily and re-established as needed; Close
+// releases it.
+func newGRPCLabelSource(cfg Config) (*grpcLabelSource, error) {
+	creds := insecure.NewCredentials()
+	if cfg.LabelGRPCTLS {
+		creds = credentials.NewTLS(&tls.Config{MinVersion: tls.VersionTLS12})
+	}
+	conn, err := grpc.NewClient(cfg.LabelGRPCAddr, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, fmt.Errorf("creating label service client: %w", err)
+	}
+	return &grpcLabelSource{
+		conn:    conn,
+		client:  labelsv1.NewLabelServiceClient(conn),
+		timeout: cfg.LabelAPITimeout,
+	}, nil
+}
+
+// Fetch implements LabelSource. Each call is bounded by the label API
+// timeout as well as ctx.
+func (s *grpcLabelSource) Fetch(ctx context.Context, namespace string) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	resp, err := s.client.GetLabels(ctx, &labelsv1.GetLabelsRequest{Namespace: namespace})
+	if err != nil {
+		return nil, fmt.Errorf("calling label service: %w", err)
+	}
+	return resp.GetLabels(), nil
+}
+
+// Close closes the connection to the label service.
+func (s *grpcLabelSource) Close() error {
+	return s.conn.Close()
+}
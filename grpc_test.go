@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	labelsv1 "github.com/david-serrano-realtor/webhookPOC/proto/labels/v1"
+)
+
+// fakeLabelService serves fixed labels per namespace, after delay.
+type fakeLabelService struct {
+	labelsv1.UnimplementedLabelServiceServer
+	labels map[string]map[string]string
+	delay  time.Duration
+}
+
+func (s *fakeLabelService) GetLabels(ctx context.Context, req *labelsv1.GetLabelsRequest) (*labelsv1.GetLabelsResponse, error) {
+	select {
+	case <-time.After(s.delay):
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+	return &labelsv1.GetLabelsResponse{Labels: s.labels[req.GetNamespace()]}, nil
+}
+
+// newBufconnLabelSource serves service in process and returns a
+// grpcLabelSource connected to it.
+func newBufconnLabelSource(t *testing.T, service labelsv1.LabelServiceServer, timeout time.Duration) *grpcLabelSource {
+	t.Helper()
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	labelsv1.RegisterLabelServiceServer(server, service)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := &grpcLabelSource{conn: conn, client: labelsv1.NewLabelServiceClient(conn), timeout: timeout}
+	t.Cleanup(func() { source.Close() })
+	return source
+}
+
+func TestGRPCLabelSource(t *testing.T) {
+	service := &fakeLabelService{labels: map[string]map[string]string{"apps": {"team": "payments"}}}
+	source := newBufconnLabelSource(t, service, time.Second)
+
+	// Both fetches share the one connection.
+	for _, namespace := range []string{"apps", "apps"} {
+		labels, err := source.Fetch(context.Background(), namespace)
+		if err != nil {
+			t.Fatalf("Fetch: %v", err)
+		}
+		if want := map[string]string{"team": "payments"}; !reflect.DeepEqual(labels, want) {
+			t.Errorf("labels = %v, want %v", labels, want)
+		}
+	}
+}
+
+func TestGRPCLabelSourceTimeout(t *testing.T) {
+	service := &fakeLabelService{delay: time.Minute}
+	source := newBufconnLabelSource(t, service, 50*time.Millisecond)
+
+	start := time.Now()
+	_, err := source.Fetch(context.Background(), "apps")
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("Fetch error = %v, want DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Fetch took %s despite the 50ms timeout", elapsed)
+	}
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"golang.org/x/time/rate"
+	"k8s.io/client-go/kubernetes"
+)
+
+// defaultLabelAPITimeout is used when LABEL_API_TIMEOUT is unset.
+const defaultLabelAPITimeout = 5 * time.Second
+
+// defaultLabelCacheTTL is used when LABEL_CACHE_TTL is unset.
+const defaultLabelCacheTTL = 30 * time.Second
+
+// defaultLabelAPIRetries is used when LABEL_API_RETRIES is unset.
+const defaultLabelAPIRetries = 3
+
+// labelAPIBackoff is the delay before the first label API retry; it doubles
+// on each subsequent retry.
+const labelAPIBackoff = 200 * time.Millisecond
+
+// defaultLabelAPIBreakerThreshold is used when LABEL_API_BREAKER_THRESHOLD is
+// unset.
+const defaultLabelAPIBreakerThreshold = 5
+
+// defaultLabelAPIBreakerCooldown is used when LABEL_API_BREAKER_COOLDOWN is
+// unset.
+const defaultLabelAPIBreakerCooldown = 30 * time.Second
+
+// errCircuitOpen is returned by breakerLabelSource while the circuit is open.
+var errCircuitOpen = errors.New("label API circuit breaker is open")
+
+// LabelSource supplies the labels applied to matching pods in a namespace.
+type LabelSource interface {
+	Fetch(ctx context.Context, namespace string) (map[string]string, error)
+}
+
+// defaultMockLabels are returned by the mock label source when MOCK_LABELS is
+// unset.
+var defaultMockLabels = map[string]string{"team": "microservices"}
+
+// mockLabelSource returns fixed labels. It backs the mock and static label
+// source types.
+type mockLabelSource struct {
+	labels map[string]string
+}
+
+// Fetch implements LabelSource. Callers get a copy, so they may modify it.
+func (s mockLabelSource) Fetch(context.Context, string) (map[string]string, error) {
+	return maps.Clone(s.labels), nil
+}
+
+// httpLabelSource fetches labels from the label API as a JSON object of
+// string values. The pod's namespace is sent as the namespace query
+// parameter.
+type httpLabelSource struct {
+	url    string
+	client *http.Client
+	// retries is the total number of attempts per Fetch.
+	retries int
+	// token, or the contents of tokenFile when set, is sent as a bearer
+	// token.
+	token     string
+	tokenFile string
+}
+
+// Fetch implements LabelSource. Network errors and 5xx responses are retried
+// with exponential backoff.
+func (s *httpLabelSource) Fetch(ctx context.Context, namespace string) (map[string]string, error) {
+	u, err := url.Parse(s.url)
+	if err != nil {
+		return nil, fmt.Errorf("parsing label API URL: %w", err)
+	}
+	query := u.Query()
+	query.Set("namespace", namespace)
+	u.RawQuery = query.Encode()
+
+	backoff := labelAPIBackoff
+	for attempt := 1; ; attempt++ {
+		labels, retryable, err := s.fetchOnce(ctx, u.String())
+		if err == nil {
+			return labels, nil
+		}
+		if !retryable || attempt >= s.retries {
+			return nil, err
+		}
+
+		slog.WarnContext(ctx, "Label API attempt failed, retrying", "attempt", attempt, "backoff", backoff, "error", err)
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w (retry abandoned: %v)", err, ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// fetchOnce makes a single label API call. It reports whether a failure is
+// worth retrying.
+func (s *httpLabelSource) fetchOnce(ctx context.Context, target string) (map[string]string, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, false, fmt.Errorf("building label API request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	// Carry the admission's trace to the label API.
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	token, err := s.bearerToken()
+	if err != nil {
+		return nil, false, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		// Give up once the caller's context is done; anything else is a
+		// network error.
+		retryable := ctx.Err() == nil
+		if errors.Is(err, context.DeadlineExceeded) || os.IsTimeout(err) {
+			return nil, retryable, fmt.Errorf("label API timed out: %w", err)
+		}
+		return nil, retryable, fmt.Errorf("calling label API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.StatusCode >= 500, fmt.Errorf("label API returned status %d", resp.StatusCode)
+	}
+
+	var labels map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&labels); err != nil {
+		return nil, false, fmt.Errorf("decoding label API response: %w", err)
+	}
+	return labels, false, nil
+}
+
+// bearerToken returns the token to authenticate with, or "" for none. The
+// token file is read on every call so rotated tokens are picked up.
+func (s *httpLabelSource) bearerToken() (string, error) {
+	if s.tokenFile == "" {
+		return s.token, nil
+	}
+	data, err := os.ReadFile(s.tokenFile)
+	if err != nil {
+		return "", fmt.Errorf("reading label API token file: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// newLabelSource builds the LabelSource selected by cfg.LabelSourceType:
+//
+//   - http: the label API, behind a cache. It is rate limited and guarded by
+//     a circuit breaker when configured; cache hits are not rate limited.
+//   - grpc: the label service at LABEL_GRPC_ADDR, wrapped like http.
+//   - mock: MOCK_LABELS, or built-in demo labels.
+//   - static: STATIC_LABELS only.
+//   - configmap: only the per-namespace labels in the overrides ConfigMap.
+//
+// Whatever the type, labels from the overrides ConfigMap, when one is
+// configured, take precedence. Watching it stops when ctx is done. The
+// returned function releases the source's connections once it is no longer
+// used.
+func newLabelSource(ctx context.Context, cfg Config, client kubernetes.Interface) (LabelSource, func() error, error) {
+	var source LabelSource
+	closeSource := func() error { return nil }
+	switch cfg.LabelSourceType {
+	case labelSourceHTTP:
+		source = newHTTPLabelSource(cfg)
+	case labelSourceGRPC:
+		grpcSource, err := newGRPCLabelSource(cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		source, closeSource = wrapRemoteLabelSource(cfg, grpcSource), grpcSource.Close
+	case labelSourceMock:
+		source = mockLabelSource{labels: cfg.MockLabels}
+	case labelSourceStatic:
+		source = mockLabelSource{labels: cfg.StaticLabels}
+	case labelSourceConfigMap:
+		// All labels come from the overrides below.
+		source = mockLabelSource{}
+	default:
+		return nil, nil, fmt.Errorf("unknown label source type %q", cfg.LabelSourceType)
+	}
+
+	if cfg.LabelOverridesConfigMap != "" {
+		namespace := cfg.LabelOverridesNamespace
+		if namespace == "" {
+			var err error
+			if namespace, err = ownNamespace(); err != nil {
+				return nil, nil, fmt.Errorf("%w; set LABEL_OVERRIDES_NAMESPACE", err)
+			}
+		}
+		overrides := &overrideLabelSource{source: source}
+		if err := overrides.watch(ctx, client, namespace, cfg.LabelOverridesConfigMap); err != nil {
+			return nil, nil, err
+		}
+		slog.Info("Watching label overrides", "namespace", namespace, "name", cfg.LabelOverridesConfigMap)
+		source = overrides
+	}
+	return source, closeSource, nil
+}
+
+// newHTTPLabelSource builds the label API source described by cfg.
+func newHTTPLabelSource(cfg Config) LabelSource {
+	return wrapRemoteLabelSource(cfg, &httpLabelSource{
+		url:       cfg.LabelAPIURL,
+		client:    &http.Client{Timeout: cfg.LabelAPITimeout},
+		retries:   cfg.LabelAPIRetries,
+		token:     cfg.LabelAPIToken,
+		tokenFile: cfg.LabelAPITokenFile,
+	})
+}
+
+// wrapRemoteLabelSource puts a label service client behind the circuit
+// breaker and rate limiter, when configured, and the cache.
+func wrapRemoteLabelSource(cfg Config, source LabelSource) LabelSource {
+	if cfg.LabelAPIBreakerThreshold > 0 {
+		source = &breakerLabelSource{
+			source:    source,
+			threshold: cfg.LabelAPIBreakerThreshold,
+			cooldown:  cfg.LabelAPIBreakerCooldown,
+		}
+	}
+	if cfg.LabelAPIRPS > 0 {
+		burst := cfg.LabelAPIBurst
+		if burst <= 0 {
+			burst = cfg.LabelAPIRPS
+		}
+		source = &rateLimitedLabelSource{
+			source:  source,
+			limiter: rate.NewLimiter(rate.Limit(cfg.LabelAPIRPS), burst),
+		}
+	}
+	return &cachedLabelSource{source: source, ttl: cfg.LabelCacheTTL}
+}
+
+// rateLimitedLabelSource limits the rate of calls to another LabelSource with
+// a token bucket. Calls over the limit wait for a token, at most until the
+// request's deadline, and then fail like any other fetch error.
+type rateLimitedLabelSource struct {
+	source  LabelSource
+	limiter *rate.Limiter
+}
+
+// Fetch implements LabelSource.
+func (s *rateLimitedLabelSource) Fetch(ctx context.Context, namespace string) (map[string]string, error) {
+	if err := s.limiter.Wait(ctx); err != nil {
+		return nil, fmt.Errorf("label API rate limit: %w", err)
+	}
+	return s.source.Fetch(ctx, namespace)
+}
+
+// breakerLabelSource is a circuit breaker around another LabelSource. After
+// threshold consecutive failures the circuit opens and Fetch fails fast with
+// errCircuitOpen for cooldown. The first Fetch after the cooldown is let
+// through as a probe (half-open); its success closes the circuit and its
+// failure reopens it. Other fetches keep failing fast while the probe is in
+// flight.
+type breakerLabelSource struct {
+	source    LabelSource
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// Fetch implements LabelSource.
+func (b *breakerLabelSource) Fetch(ctx context.Context, namespace string) (map[string]string, error) {
+	if !b.allow() {
+		return nil, errCircuitOpen
+	}
+	labels, err := b.source.Fetch(ctx, namespace)
+	b.record(ctx, err)
+	if err != nil {
+		return nil, err
+	}
+	return labels, nil
+}
+
+// allow reports whether a call may go through, claiming the probe slot when
+// the cooldown has elapsed.
+func (b *breakerLabelSource) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold {
+		return true
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// record updates the breaker with the outcome of a call.
+func (b *breakerLabelSource) record(ctx context.Context, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	wasOpen := b.failures >= b.threshold
+	b.probing = false
+	if err == nil {
+		if wasOpen {
+			slog.InfoContext(ctx, "Label API circuit breaker closed")
+		}
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+		if !wasOpen {
+			slog.WarnContext(ctx, "Label API circuit breaker opened", "failures", b.failures, "cooldown", b.cooldown)
+		}
+	}
+}
+
+// cachedLabelSource caches the results of another LabelSource per namespace.
+// Entries are never evicted; they are bounded by the cluster's namespaces,
+// as /preview only fetches for namespaces that exist.
+type cachedLabelSource struct {
+	source LabelSource
+	ttl    time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*labelCacheEntry
+}
+
+// labelCacheEntry is the cached result for one namespace.
+type labelCacheEntry struct {
+	mu      sync.Mutex
+	labels  map[string]string
+	expires time.Time
+}
+
+// Fetch implements LabelSource, calling the underlying source when the cached
+// labels are missing or have expired. The entry's lock is held across the
+// call so concurrent misses for a namespace share one fetch. A non-positive
+// TTL disables caching.
+func (c *cachedLabelSource) Fetch(ctx context.Context, namespace string) (map[string]string, error) {
+	if c.ttl <= 0 {
+		return c.source.Fetch(ctx, namespace)
+	}
+
+	c.mu.Lock()
+	if c.entries == nil {
+		c.entries = make(map[string]*labelCacheEntry)
+	}
+	entry, ok := c.entries[namespace]
+	if !ok {
+		entry = &labelCacheEntry{}
+		c.entries[namespace] = entry
+	}
+	c.mu.Unlock()
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	if time.Now().Before(entry.expires) {
+		return entry.labels, nil
+	}
+
+	labels, err := c.source.Fetch(ctx, namespace)
+	if err != nil {
+		return nil, err
+	}
+	entry.labels = labels
+	entry.expires = time.Now().Add(c.ttl)
+	return labels, nil
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// httpTestConfig returns a configuration using the label API at url.
+func httpTestConfig(t *testing.T, url string) Config {
+	t.Helper()
+	cfg := testConfig(t)
+	cfg.LabelSourceType = labelSourceHTTP
+	cfg.LabelAPIURL = url
+	return cfg
+}
+
+func TestMutateLabelAPITimeout(t *testing.T) {
+	const handlerDelay = 5 * time.Second
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(handlerDelay):
+			w.Write([]byte(`{"team":"payments"}`))
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+
+	cfg := httpTestConfig(t, server.URL)
+	cfg.LabelAPITimeout = 50 * time.Millisecond
+	cfg.LabelAPIRetries = 1
+	wh := newTestWebhook(t, cfg, newHTTPLabelSource(cfg))
+
+	start := time.Now()
+	resp := wh.mutate(context.Background(), podReview(t, testPod(map[string]string{targetLabel: "abc"}), admissionv1.Create))
+	if elapsed := time.Since(start); elapsed >= handlerDelay {
+		t.Errorf("mutate took %v, want it to give up before the handler's %v", elapsed, handlerDelay)
+	}
+
+	if resp.Allowed {
+		t.Fatal("mutate allowed the request, want a denial")
+	}
+	if msg := resultMessage(resp); !strings.Contains(msg, "label API timed out") {
+		t.Errorf("Status.Message = %q, want the label API timeout", msg)
+	}
+}
+
+func TestMutateCachesLabels(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Write([]byte(`{"team":"payments"}`))
+	}))
+	defer server.Close()
+
+	cfg := httpTestConfig(t, server.URL)
+	wh := newTestWebhook(t, cfg, newHTTPLabelSource(cfg))
+
+	for range 2 {
+		resp := wh.mutate(context.Background(), podReview(t, testPod(map[string]string{targetLabel: "abc"}), admissionv1.Create))
+		if !resp.Allowed || len(resp.Patch) == 0 {
+			t.Fatalf("mutate = allowed %v, patch %s; want a patch", resp.Allowed, resp.Patch)
+		}
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("label API called %d times, want 1 within the cache TTL", got)
+	}
+}
+
+func TestHTTPLabelSourceRetries(t *testing.T) {
+	tests := []struct {
+		name      string
+		failures  int32
+		status    int
+		wantCalls int32
+		wantErr   bool
+	}{
+		{name: "5xx retried until the third attempt succeeds", failures: 2, status: http.StatusServiceUnavailable, wantCalls: 3},
+		{name: "4xx not retried", failures: 2, status: http.StatusNotFound, wantCalls: 1, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if calls.Add(1) <= tt.failures {
+					w.WriteHeader(tt.status)
+					return
+				}
+				w.Write([]byte(`{"team":"payments"}`))
+			}))
+			defer server.Close()
+
+			source := &httpLabelSource{url: server.URL, client: server.Client(), retries: 3}
+			labels, err := source.Fetch(context.Background(), "apps")
+
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Fetch = %v, want an error", labels)
+				}
+			} else if err != nil || labels["team"] != "payments" {
+				t.Errorf("Fetch = %v, %v; want the labels of the last attempt", labels, err)
+			}
+			if got := calls.Load(); got != tt.wantCalls {
+				t.Errorf("label API called %d times, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestBreakerLabelSource(t *testing.T) {
+	const cooldown = 50 * time.Millisecond
+	source := &fakeLabelSource{labels: map[string]string{"team": "payments"}, err: errors.New("label API down")}
+	breaker := &breakerLabelSource{source: source, threshold: 2, cooldown: cooldown}
+	ctx := context.Background()
+
+	steps := []struct {
+		name      string
+		wait      bool
+		healthy   bool
+		wantErr   error
+		wantCalls int
+	}{
+		{name: "closed, first failure", wantErr: source.err, wantCalls: 1},
+		{name: "closed, failure at the threshold opens", wantErr: source.err, wantCalls: 2},
+		{name: "open fails fast", wantErr: errCircuitOpen, wantCalls: 2},
+		{name: "half-open probe fails and reopens", wait: true, wantErr: source.err, wantCalls: 3},
+		{name: "reopened fails fast", wantErr: errCircuitOpen, wantCalls: 3},
+		{name: "half-open probe succeeds and closes", wait: true, healthy: true, wantCalls: 4},
+		{name: "closed lets calls through", healthy: true, wantCalls: 5},
+	}
+
+	for _, step := range steps {
+		if step.wait {
+			time.Sleep(cooldown)
+		}
+		if step.healthy {
+			source.err = nil
+		}
+		_, err := breaker.Fetch(ctx, "apps")
+		if !errors.Is(err, step.wantErr) {
+			t.Fatalf("%s: Fetch error = %v, want %v", step.name, err, step.wantErr)
+		}
+		if source.calls != step.wantCalls {
+			t.Fatalf("%s: source called %d times, want %d", step.name, source.calls, step.wantCalls)
+		}
+	}
+}
+
+func TestRateLimitedLabelSource(t *testing.T) {
+	const (
+		fetches = 20
+		rps     = 50
+		burst   = 5
+	)
+	source := &fakeLabelSource{labels: map[string]string{"team": "payments"}}
+	limited := &rateLimitedLabelSource{source: source, limiter: rate.NewLimiter(rps, burst)}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	errs := make(chan error, fetches)
+	for range fetches {
+		wg.Go(func() {
+			if _, err := limited.Fetch(context.Background(), "apps"); err != nil {
+				errs <- err
+			}
+		})
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("Fetch: %v", err)
+	}
+	if source.calls != fetches {
+		t.Errorf("source called %d times, want %d", source.calls, fetches)
+	}
+	// Past the burst, each fetch waits for a token.
+	if want := time.Duration(fetches-burst) * time.Second / rps; time.Since(start) < want {
+		t.Errorf("fetches took %v, want at least %v", time.Since(start), want)
+	}
+
+	// A fetch that cannot get a token before its deadline fails instead of
+	// waiting.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if _, err := limited.Fetch(ctx, "apps"); err == nil {
+		t.Error("Fetch past the deadline succeeded, want a rate limit error")
+	}
+}
+
+func TestHTTPLabelSourceSendsNamespace(t *testing.T) {
+	queries := make(chan url.Values, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries <- r.URL.Query()
+		w.Write([]byte(`{"team":"payments"}`))
+	}))
+	defer server.Close()
+
+	// Query parameters already in the URL are kept.
+	source := &httpLabelSource{url: server.URL + "?cluster=prod", client: server.Client(), retries: 1}
+	if _, err := source.Fetch(context.Background(), "apps"); err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	query := <-queries
+	if got := query.Get("namespace"); got != "apps" {
+		t.Errorf("namespace query = %q, want %q", got, "apps")
+	}
+	if got := query.Get("cluster"); got != "prod" {
+		t.Errorf("cluster query = %q, want the URL's own %q", got, "prod")
+	}
+}
+
+func TestHTTPLabelSourceBearerToken(t *testing.T) {
+	headers := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header.Get("Authorization")
+		w.Write([]byte(`{"team":"payments"}`))
+	}))
+	defer server.Close()
+
+	fetchAuthorization := func(t *testing.T, source *httpLabelSource) string {
+		t.Helper()
+		if _, err := source.Fetch(context.Background(), "apps"); err != nil {
+			t.Fatalf("Fetch: %v", err)
+		}
+		return <-headers
+	}
+
+	t.Run("none", func(t *testing.T) {
+		source := &httpLabelSource{url: server.URL, client: server.Client(), retries: 1}
+		if got := fetchAuthorization(t, source); got != "" {
+			t.Errorf("Authorization = %q, want none", got)
+		}
+	})
+
+	t.Run("token", func(t *testing.T) {
+		source := &httpLabelSource{url: server.URL, client: server.Client(), retries: 1, token: "secret"}
+		if got := fetchAuthorization(t, source); got != "Bearer secret" {
+			t.Errorf("Authorization = %q, want %q", got, "Bearer secret")
+		}
+	})
+
+	t.Run("token file re-read on every call", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "token")
+		source := &httpLabelSource{url: server.URL, client: server.Client(), retries: 1, token: "ignored", tokenFile: path}
+		for _, token := range []string{"first", "rotated"} {
+			if err := os.WriteFile(path, []byte(token+"\n"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if got := fetchAuthorization(t, source); got != "Bearer "+token {
+				t.Errorf("Authorization = %q, want %q", got, "Bearer "+token)
+			}
+		}
+	})
+}
+
+func TestNewLabelSource(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"team":"from-http"}`))
+	}))
+	defer server.Close()
+	overrides := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "webhook", Name: "label-overrides"},
+		Data:       map[string]string{"apps": "team=from-configmap"},
+	}
+
+	tests := []struct {
+		name   string
+		config func(cfg *Config)
+		want   map[string]string
+	}{
+		{
+			name: labelSourceHTTP,
+			config: func(cfg *Config) {
+				cfg.LabelSourceType, cfg.LabelAPIURL = labelSourceHTTP, server.URL
+			},
+			want: map[string]string{"team": "from-http"},
+		},
+		{
+			name: labelSourceMock,
+			config: func(cfg *Config) {
+				cfg.LabelSourceType, cfg.MockLabels = labelSourceMock, map[string]string{"team": "from-mock"}
+			},
+			want: map[string]string{"team": "from-mock"},
+		},
+		{
+			name: labelSourceStatic,
+			config: func(cfg *Config) {
+				cfg.LabelSourceType, cfg.StaticLabels = labelSourceStatic, map[string]string{"team": "from-static"}
+			},
+			want: map[string]string{"team": "from-static"},
+		},
+		{
+			name: labelSourceConfigMap,
+			config: func(cfg *Config) {
+				cfg.LabelSourceType = labelSourceConfigMap
+				cfg.LabelOverridesConfigMap, cfg.LabelOverridesNamespace = "label-overrides", "webhook"
+			},
+			want: map[string]string{"team": "from-configmap"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t)
+			tt.config(&cfg)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			source, closeSource, err := newLabelSource(ctx, cfg, fake.NewSimpleClientset(overrides))
+			if err != nil {
+				t.Fatalf("newLabelSource: %v", err)
+			}
+			defer closeSource()
+			got, err := source.Fetch(ctx, "apps")
+			if err != nil {
+				t.Fatalf("Fetch: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Fetch = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run(labelSourceGRPC, func(t *testing.T) {
+		cfg := testConfig(t)
+		cfg.LabelSourceType, cfg.LabelGRPCAddr = labelSourceGRPC, "localhost:9090"
+		// Without the breaker and rate limiter only the cache wraps it.
+		cfg.LabelAPIBreakerThreshold, cfg.LabelAPIRPS = 0, 0
+		source, closeSource, err := newLabelSource(context.Background(), cfg, fake.NewSimpleClientset())
+		if err != nil {
+			t.Fatalf("newLabelSource: %v", err)
+		}
+		// The client connects lazily, so only its wiring is checked.
+		cached, ok := source.(*cachedLabelSource)
+		if !ok {
+			t.Fatalf("source = %T, want *cachedLabelSource", source)
+		}
+		if _, ok := cached.source.(*grpcLabelSource); !ok {
+			t.Errorf("cached source = %T, want *grpcLabelSource", cached.source)
+		}
+		if err := closeSource(); err != nil {
+			t.Errorf("closing the source: %v", err)
+		}
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		cfg := testConfig(t)
+		cfg.LabelSourceType = "ldap"
+		if _, _, err := newLabelSource(context.Background(), cfg, fake.NewSimpleClientset()); err == nil {
+			t.Error("newLabelSource succeeded for an unknown type, want an error")
+		}
+	})
+}
+
+func TestMutateDisableLabelAPI(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Write([]byte(`{"team":"from-api"}`))
+	}))
+	defer server.Close()
+	t.Setenv("LABEL_API_URL", server.URL)
+	t.Setenv("DISABLE_LABEL_API", "true")
+	t.Setenv("STATIC_LABELS", "team=platform")
+	cfg := testConfig(t)
+	source, closeSource, err := newLabelSource(context.Background(), cfg, fake.NewSimpleClientset())
+	if err != nil {
+		t.Fatalf("newLabelSource: %v", err)
+	}
+	defer closeSource()
+	wh := newTestWebhook(t, cfg, source)
+
+	resp := wh.mutate(context.Background(), podReview(t, testPod(map[string]string{targetLabel: "abc"}), admissionv1.Create))
+
+	if !resp.Allowed {
+		t.Fatalf("mutate denied the request: %s", resultMessage(resp))
+	}
+	if got := calls.Load(); got != 0 {
+		t.Errorf("label API called %d times, want 0", got)
+	}
+	want := []patchOp{
+		{Op: "add", Path: "/metadata/labels/team", Value: "platform"},
+		{Op: "add", Path: "/metadata/annotations", Value: map[string]interface{}{}},
+		{Op: "add", Path: markerPath, Value: ""},
+	}
+	if got := decodePatch(t, resp); !reflect.DeepEqual(got, want) {
+		t.Errorf("patch = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// setupLogging installs a JSON slog logger as the default, at the level given
+// by LOG_LEVEL (debug, info, warn or error; default info).
+func setupLogging() {
+	var level slog.Level
+	if value := getenv("LOG_LEVEL"); value != "" {
+		if err := level.UnmarshalText([]byte(value)); err != nil {
+			fatal("Invalid environment variable", "name", "LOG_LEVEL", "value", value, "error", err)
+		}
+	}
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level})))
+}
+
+// fatal logs msg at error level and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// requestLogger returns a logger annotated with the admission request's UID
+// and namespace.
+func (wh *Webhook) requestLogger(req *admissionv1.AdmissionRequest) *slog.Logger {
+	return wh.logger.With("uid", req.UID, "namespace", req.Namespace, "operation", req.Operation)
+}
+
+// podName returns the pod's name, falling back to its generateName since
+// pods created by controllers are often unnamed at admission time.
+func podName(pod *corev1.Pod) string {
+	if pod.Name != "" {
+		return pod.Name
+	}
+	return pod.GenerateName
+}
+
+// podOwner returns the pod's controlling owner as "Kind/name", typically its
+// ReplicaSet, or "" if it has none.
+func podOwner(pod *corev1.Pod) string {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil {
+		return ""
+	}
+	return owner.Kind + "/" + owner.Name
+}
+
+// decision summarizes an admission response for logging.
+func decision(resp *admissionv1.AdmissionResponse) string {
+	switch {
+	case resp == nil || !resp.Allowed:
+		return "denied"
+	case len(resp.Patch) > 0:
+		return "mutated"
+	default:
+		return "allowed"
+	}
+}
+
+// resultMessage returns the status message of an admission response, if any.
+func resultMessage(resp *admissionv1.AdmissionResponse) string {
+	if resp == nil || resp.Result == nil {
+		return ""
+	}
+	return resp.Result.Message
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+// admissionMetricLabels break the admission counters down by request. The
+// namespace label is bounded by namespaceMetrics.
+var admissionMetricLabels = []string{"namespace", "operation"}
+
+// defaultMetricsNamespaceLimit is used when METRICS_NAMESPACE_LIMIT is unset.
+const defaultMetricsNamespaceLimit = 100
+
+// otherNamespaceLabel is the namespace label of namespaces over the limit.
+const otherNamespaceLabel = "other"
+
+// Admission metrics, served at /metrics.
+var (
+	admissionRequestsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "webhook_admission_requests_total",
+		Help: "Total number of admission requests received on /mutate.",
+	})
+	admissionMutatedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_admission_mutated_total",
+		Help: "Number of admission requests that were allowed with a patch.",
+	}, admissionMetricLabels)
+	admissionAllowedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_admission_allowed_total",
+		Help: "Number of admission requests that were allowed without mutation.",
+	}, admissionMetricLabels)
+	admissionErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_admission_errors_total",
+		Help: "Number of admission requests that failed or were denied due to an error.",
+	}, admissionMetricLabels)
+	mutationDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "webhook_mutation_duration_seconds",
+		Help:    "Time spent computing the admission response.",
+		Buckets: prometheus.DefBuckets,
+	})
+)
+
+// namespaceMetrics bounds the cardinality of the namespace metric label: the
+// first limit namespaces seen get their own value, later ones are bucketed
+// as otherNamespaceLabel.
+type namespaceMetrics struct {
+	limit int
+
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+// label returns the metric label value for namespace.
+func (m *namespaceMetrics) label(namespace string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.seen[namespace] {
+		return namespace
+	}
+	if len(m.seen) >= m.limit {
+		return otherNamespaceLabel
+	}
+	if m.seen == nil {
+		m.seen = make(map[string]bool)
+	}
+	m.seen[namespace] = true
+	return namespace
+}
+
+// admissionCounters are the admission counters for one request.
+type admissionCounters struct {
+	allowed, mutated, errors prometheus.Counter
+}
+
+// countersFor returns the admission counters for req. Previews get
+// unregistered counters, so they neither show up in /metrics nor take up
+// namespace label values.
+func (wh *Webhook) countersFor(ctx context.Context, req *admissionv1.AdmissionRequest) admissionCounters {
+	if isPreview(ctx) {
+		discard := prometheus.NewCounter(prometheus.CounterOpts{Name: "preview_discarded"})
+		return admissionCounters{allowed: discard, mutated: discard, errors: discard}
+	}
+	labels := []string{wh.namespaceMetrics.label(req.Namespace), string(req.Operation)}
+	return admissionCounters{
+		allowed: admissionAllowedTotal.WithLabelValues(labels...),
+		mutated: admissionMutatedTotal.WithLabelValues(labels...),
+		errors:  admissionErrorsTotal.WithLabelValues(labels...),
+	}
+}
+
+// stats holds cumulative /mutate counts served as JSON at /stats, for quick
+// checks without a Prometheus setup. Mutated, allowed and denied partition
+// the requests that reached the mutation logic; errors counts malformed
+// requests rejected before it, on any admission endpoint.
+var stats struct {
+	total   atomic.Int64
+	mutated atomic.Int64
+	allowed atomic.Int64
+	denied  atomic.Int64
+	errors  atomic.Int64
+}
+
+// recordDecision counts the outcome of one mutation in stats.
+func recordDecision(resp *admissionv1.AdmissionResponse) {
+	switch {
+	case !resp.Allowed:
+		stats.denied.Add(1)
+	case len(resp.Patch) > 0:
+		stats.mutated.Add(1)
+	default:
+		stats.allowed.Add(1)
+	}
+}
+
+// serveStats reports the stats counters as JSON.
+func serveStats(w http.ResponseWriter, r *http.Request) {
+	body, _ := json.Marshal(map[string]int64{
+		"total":   stats.total.Load(),
+		"mutated": stats.mutated.Load(),
+		"allowed": stats.allowed.Load(),
+		"denied":  stats.denied.Load(),
+		"errors":  stats.errors.Load(),
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+func TestAdmissionMetricsNamespaceLabel(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.MetricsNamespaceLimit = 1
+	wh := newTestWebhook(t, cfg, &fakeLabelSource{labels: map[string]string{"team": "payments"}})
+	firstBefore := testutil.ToFloat64(admissionMutatedTotal.WithLabelValues("metrics-first", string(admissionv1.Create)))
+	otherBefore := testutil.ToFloat64(admissionMutatedTotal.WithLabelValues(otherNamespaceLabel, string(admissionv1.Create)))
+
+	for _, namespace := range []string{"metrics-first", "metrics-second"} {
+		pod := testPod(map[string]string{targetLabel: "abc"})
+		pod.Namespace = namespace
+		if resp := wh.mutate(context.Background(), podReview(t, pod, admissionv1.Create)); len(resp.Patch) == 0 {
+			t.Fatalf("pod in %s was not mutated: %s", namespace, resultMessage(resp))
+		}
+	}
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("gathering metrics: %v", err)
+	}
+	// Mutations per namespace label value, for CREATE.
+	mutated := map[string]float64{}
+	for _, family := range families {
+		if family.GetName() != "webhook_admission_mutated_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, pair := range metric.GetLabel() {
+				labels[pair.GetName()] = pair.GetValue()
+			}
+			if labels["operation"] == string(admissionv1.Create) {
+				mutated[labels["namespace"]] = metric.GetCounter().GetValue()
+			}
+		}
+	}
+
+	if got := mutated["metrics-first"] - firstBefore; got != 1 {
+		t.Errorf("mutated{namespace=metrics-first} went up by %v, want 1", got)
+	}
+	if got, ok := mutated["metrics-second"]; ok {
+		t.Errorf("mutated{namespace=metrics-second} = %v, want no series past the limit", got)
+	}
+	if got := mutated[otherNamespaceLabel] - otherBefore; got != 1 {
+		t.Errorf("mutated{namespace=%s} went up by %v, want 1", otherNamespaceLabel, got)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+)
+
+// defaultNamespaceCacheTTL is used when NAMESPACE_CACHE_TTL is unset.
+const defaultNamespaceCacheTTL = 30 * time.Second
+
+// namespaceCache caches Namespace lookups briefly so admissions don't each
+// hit the API server.
+type namespaceCache struct {
+	client kubernetes.Interface
+	ttl    time.Duration
+
+	mu      sync.Mutex
+	entries map[string]namespaceCacheEntry
+}
+
+// namespaceCacheEntry is a cached Namespace and when it goes stale.
+type namespaceCacheEntry struct {
+	namespace *corev1.Namespace
+	expires   time.Time
+}
+
+// newNamespaceCache returns a namespaceCache backed by client.
+func newNamespaceCache(client kubernetes.Interface, ttl time.Duration) *namespaceCache {
+	return &namespaceCache{
+		client:  client,
+		ttl:     ttl,
+		entries: make(map[string]namespaceCacheEntry),
+	}
+}
+
+// Get returns the named Namespace, from the cache when fresh. Concurrent
+// misses may each call the API server; the results are equivalent.
+func (c *namespaceCache) Get(ctx context.Context, name string) (*corev1.Namespace, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[name]
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.namespace, nil
+	}
+
+	namespace, err := c.client.CoreV1().Namespaces().Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.entries[name] = namespaceCacheEntry{namespace: namespace, expires: time.Now().Add(c.ttl)}
+	c.mu.Unlock()
+	return namespace, nil
+}
+
+// namespaceSelected reports whether the named namespace's labels match the
+// configured namespace selector. Without a selector every namespace matches.
+func (wh *Webhook) namespaceSelected(ctx context.Context, name string) (bool, error) {
+	if wh.namespaceSelector == nil {
+		return true, nil
+	}
+	namespace, err := wh.namespaces.Get(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	return wh.namespaceSelector.Matches(labels.Set(namespace.Labels)), nil
+}
+
+// parseNamespaceAnnotationLabels parses NAMESPACE_ANNOTATION_LABELS: a list
+// of namespace annotation keys, each optionally mapped to a different pod
+// label key with annotation=label.
+func parseNamespaceAnnotationLabels(s string) (map[string]string, error) {
+	keys := make(map[string]string)
+	for _, item := range splitList(s) {
+		annotation, label, ok := strings.Cut(item, "=")
+		annotation, label = strings.TrimSpace(annotation), strings.TrimSpace(label)
+		if !ok {
+			label = annotation
+		}
+		if annotation == "" || label == "" {
+			return nil, fmt.Errorf("malformed entry %q, want annotation or annotation=label", item)
+		}
+		keys[annotation] = label
+	}
+	return keys, nil
+}
+
+// namespaceAnnotationLabels returns the configured annotations of the named
+// namespace as labels, under their mapped keys. Annotations the namespace
+// does not carry are skipped.
+func (wh *Webhook) namespaceAnnotationLabels(ctx context.Context, name string) (map[string]string, error) {
+	namespace, err := wh.namespaces.Get(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("getting namespace %s: %w", name, err)
+	}
+	found := make(map[string]string)
+	for annotation, label := range wh.config.NamespaceAnnotationLabels {
+		if value, ok := namespace.Annotations[annotation]; ok {
+			found[label] = value
+		}
+	}
+	return found, nil
+}
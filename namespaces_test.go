@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestMutateNamespaceSelector(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.NamespaceSelector = "labels=enabled"
+	selected := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "apps", Labels: map[string]string{"labels": "enabled"}}}
+	other := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "other"}}
+
+	tests := []struct {
+		name        string
+		namespace   string
+		labels      map[string]string
+		wantAllowed bool
+		wantPatch   bool
+	}{
+		{"selected namespace", "apps", map[string]string{targetLabel: "abc"}, true, true},
+		{"unselected namespace", "other", map[string]string{targetLabel: "abc"}, true, false},
+		// The lookup fails, but the pod is not targeted so it never runs.
+		{"untargeted pod in unreadable namespace", "missing", map[string]string{"app": "web"}, true, false},
+		{"targeted pod in unreadable namespace", "missing", map[string]string{targetLabel: "abc"}, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wh := newTestWebhook(t, cfg, &fakeLabelSource{labels: map[string]string{"team": "payments"}}, selected, other)
+			pod := testPod(tt.labels)
+			pod.Namespace = tt.namespace
+
+			resp := wh.mutate(context.Background(), podReview(t, pod, admissionv1.Create))
+
+			if resp.Allowed != tt.wantAllowed {
+				t.Fatalf("Allowed = %v, want %v (%s)", resp.Allowed, tt.wantAllowed, resultMessage(resp))
+			}
+			if hasPatch := len(resp.Patch) > 0; hasPatch != tt.wantPatch {
+				t.Errorf("patch = %s, want patch: %v", resp.Patch, tt.wantPatch)
+			}
+		})
+	}
+}
+
+func TestNamespaceAnnotationLabels(t *testing.T) {
+	mapping, err := parseNamespaceAnnotationLabels("example.com/cost-center=cost-center, example.com/team , example.com/missing=absent")
+	if err != nil {
+		t.Fatalf("parseNamespaceAnnotationLabels: %v", err)
+	}
+	cfg := testConfig(t)
+	cfg.NamespaceAnnotationLabels = mapping
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name: "apps",
+		Annotations: map[string]string{
+			"example.com/cost-center": "cc-42",
+			"example.com/team":        "payments",
+			"example.com/unrelated":   "ignored",
+		},
+	}}
+	wh := newTestWebhook(t, cfg, &fakeLabelSource{}, namespace)
+
+	got, err := wh.namespaceAnnotationLabels(context.Background(), "apps")
+	if err != nil {
+		t.Fatalf("namespaceAnnotationLabels: %v", err)
+	}
+	// Remapped, kept under its own key, and skipped when missing.
+	want := map[string]string{"cost-center": "cc-42", "example.com/team": "payments"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("namespaceAnnotationLabels = %v, want %v", got, want)
+	}
+
+	if _, err := wh.namespaceAnnotationLabels(context.Background(), "missing"); err == nil {
+		t.Error("namespaceAnnotationLabels for a missing namespace succeeded, want an error")
+	}
+}
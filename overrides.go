@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// serviceAccountNamespaceFile holds the namespace the webhook runs in.
+const serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// overrideLabelSource layers per-namespace labels from a watched ConfigMap
+// over another LabelSource. Each ConfigMap data key is a namespace and its
+// value the labels for it, as comma-separated key=value pairs, e.g.
+//
+//	data:
+//	  payments: team=payments,tier=critical
+//
+// Override values win over the underlying source's on key collisions.
+type overrideLabelSource struct {
+	source LabelSource
+
+	mu        sync.RWMutex
+	overrides map[string]map[string]string
+}
+
+// Fetch implements LabelSource.
+func (s *overrideLabelSource) Fetch(ctx context.Context, namespace string) (map[string]string, error) {
+	labels, err := s.source.Fetch(ctx, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	override := s.overrides[namespace]
+	s.mu.RUnlock()
+	if len(override) == 0 {
+		return labels, nil
+	}
+
+	// The underlying map may be shared by a cache, so don't modify it.
+	merged := make(map[string]string, len(labels)+len(override))
+	maps.Copy(merged, labels)
+	maps.Copy(merged, override)
+	return merged, nil
+}
+
+// watch keeps the overrides in sync with the named ConfigMap until ctx is
+// done. It returns once the initial state has been loaded.
+func (s *overrideLabelSource) watch(ctx context.Context, client kubernetes.Interface, namespace, name string) error {
+	factory := informers.NewSharedInformerFactoryWithOptions(client, 0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+		}),
+	)
+	informer := factory.Core().V1().ConfigMaps().Informer()
+	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			s.load(obj.(*corev1.ConfigMap))
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			s.load(obj.(*corev1.ConfigMap))
+		},
+		DeleteFunc: func(interface{}) {
+			slog.Warn("Label overrides ConfigMap deleted, clearing overrides", "namespace", namespace, "name", name)
+			s.set(nil)
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("watching label overrides: %w", err)
+	}
+
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return fmt.Errorf("label overrides ConfigMap %s/%s did not sync", namespace, name)
+	}
+	return nil
+}
+
+// load replaces the overrides with those in cm. Malformed entries are logged
+// and skipped so one bad namespace doesn't drop the rest.
+func (s *overrideLabelSource) load(cm *corev1.ConfigMap) {
+	overrides := make(map[string]map[string]string, len(cm.Data))
+	for namespace, value := range cm.Data {
+		labels, err := parseKeyValueList(value)
+		if err != nil {
+			slog.Error("Skipping malformed label override", "configMap", cm.Name, "namespace", namespace, "error", err)
+			continue
+		}
+		overrides[namespace] = labels
+	}
+	slog.Info("Loaded label overrides", "configMap", cm.Name, "namespaces", len(overrides))
+	s.set(overrides)
+}
+
+// set replaces the overrides.
+func (s *overrideLabelSource) set(overrides map[string]map[string]string) {
+	s.mu.Lock()
+	s.overrides = overrides
+	s.mu.Unlock()
+}
+
+// ownNamespace returns the namespace the webhook runs in, from its service
+// account.
+func ownNamespace() (string, error) {
+	data, err := os.ReadFile(serviceAccountNamespaceFile)
+	if err != nil {
+		return "", fmt.Errorf("reading own namespace: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestOverrideLabelSource(t *testing.T) {
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "webhook", Name: "label-overrides"},
+		Data: map[string]string{
+			"apps":   "team=platform,tier=critical",
+			"broken": "no-equals-sign",
+		},
+	}
+	client := fake.NewSimpleClientset(cm)
+	s := &overrideLabelSource{source: &fakeLabelSource{labels: map[string]string{"team": "payments", "owner": "alice"}}}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	if err := s.watch(ctx, client, "webhook", "label-overrides"); err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+
+	tests := []struct {
+		namespace string
+		want      map[string]string
+	}{
+		{"apps", map[string]string{"team": "platform", "tier": "critical", "owner": "alice"}},
+		{"broken", map[string]string{"team": "payments", "owner": "alice"}},
+		{"other", map[string]string{"team": "payments", "owner": "alice"}},
+	}
+	for _, tt := range tests {
+		got, err := s.Fetch(ctx, tt.namespace)
+		if err != nil {
+			t.Fatalf("Fetch(%q): %v", tt.namespace, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Fetch(%q) = %v, want %v", tt.namespace, got, tt.want)
+		}
+	}
+
+	// Updates to the ConfigMap are picked up without a restart.
+	cm.Data = map[string]string{"other": "team=search"}
+	if _, err := client.CoreV1().ConfigMaps("webhook").Update(ctx, cm, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"team": "search", "owner": "alice"}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got, err := s.Fetch(ctx, "other")
+		if err != nil {
+			t.Fatalf("Fetch: %v", err)
+		}
+		if reflect.DeepEqual(got, want) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Fetch(%q) = %v after the update, want %v", "other", got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// maxOwnerDepth bounds how far up the controller chain ownerLabels looks,
+// e.g. pod -> ReplicaSet -> Deployment.
+const maxOwnerDepth = 2
+
+// ownerLabels returns the values of the configured OwnerLabelKeys found on
+// the pod's controllers, walking up from the pod's own controller (e.g. a
+// ReplicaSet) to its controller (e.g. a Deployment). The nearest owner
+// carrying a key wins. Missing owners and owners of unsupported kinds end
+// the walk.
+func (wh *Webhook) ownerLabels(ctx context.Context, namespace string, owner *metav1.OwnerReference) (map[string]string, error) {
+	found := make(map[string]string)
+	for depth := 0; owner != nil && depth < maxOwnerDepth; depth++ {
+		meta, err := wh.getOwner(ctx, namespace, owner)
+		// An owner deleted in the meantime just has no labels to give.
+		if apierrors.IsNotFound(err) {
+			break
+		}
+		if err != nil {
+			return found, fmt.Errorf("getting owner %s/%s: %w", owner.Kind, owner.Name, err)
+		}
+		if meta == nil {
+			break
+		}
+		for _, key := range wh.config.OwnerLabelKeys {
+			if _, done := found[key]; done {
+				continue
+			}
+			if value, ok := meta.Labels[key]; ok {
+				found[key] = value
+			}
+		}
+		owner = metav1.GetControllerOf(meta)
+	}
+	return found, nil
+}
+
+// getOwner fetches the object metadata of a pod's controller. It returns nil
+// and no error for kinds it does not know how to fetch.
+func (wh *Webhook) getOwner(ctx context.Context, namespace string, owner *metav1.OwnerReference) (*metav1.ObjectMeta, error) {
+	opts := metav1.GetOptions{}
+	switch owner.APIVersion + "/" + owner.Kind {
+	case "apps/v1/ReplicaSet":
+		obj, err := wh.client.AppsV1().ReplicaSets(namespace).Get(ctx, owner.Name, opts)
+		if err != nil {
+			return nil, err
+		}
+		return &obj.ObjectMeta, nil
+	case "apps/v1/Deployment":
+		obj, err := wh.client.AppsV1().Deployments(namespace).Get(ctx, owner.Name, opts)
+		if err != nil {
+			return nil, err
+		}
+		return &obj.ObjectMeta, nil
+	case "apps/v1/StatefulSet":
+		obj, err := wh.client.AppsV1().StatefulSets(namespace).Get(ctx, owner.Name, opts)
+		if err != nil {
+			return nil, err
+		}
+		return &obj.ObjectMeta, nil
+	case "apps/v1/DaemonSet":
+		obj, err := wh.client.AppsV1().DaemonSets(namespace).Get(ctx, owner.Name, opts)
+		if err != nil {
+			return nil, err
+		}
+		return &obj.ObjectMeta, nil
+	case "batch/v1/Job":
+		obj, err := wh.client.BatchV1().Jobs(namespace).Get(ctx, owner.Name, opts)
+		if err != nil {
+			return nil, err
+		}
+		return &obj.ObjectMeta, nil
+	case "batch/v1/CronJob":
+		obj, err := wh.client.BatchV1().CronJobs(namespace).Get(ctx, owner.Name, opts)
+		if err != nil {
+			return nil, err
+		}
+		return &obj.ObjectMeta, nil
+	}
+	return nil, nil
+}
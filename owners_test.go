@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestOwnerLabels(t *testing.T) {
+	isController := true
+	deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "apps",
+		Name:      "web",
+		Labels:    map[string]string{"team": "payments", "app.kubernetes.io/version": "v1"},
+	}}
+	replicaSet := &appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "apps",
+		Name:      "web-5d8f",
+		Labels:    map[string]string{"app.kubernetes.io/version": "v2"},
+		OwnerReferences: []metav1.OwnerReference{
+			{APIVersion: "apps/v1", Kind: "Deployment", Name: "web", Controller: &isController},
+		},
+	}}
+	cfg := testConfig(t)
+	cfg.OwnerLabelKeys = []string{"team", "app.kubernetes.io/version", "missing"}
+	wh := newTestWebhook(t, cfg, &fakeLabelSource{}, deployment, replicaSet)
+
+	tests := []struct {
+		name  string
+		owner *metav1.OwnerReference
+		want  map[string]string
+	}{
+		{
+			name:  "nearest owner wins",
+			owner: &metav1.OwnerReference{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "web-5d8f"},
+			want:  map[string]string{"team": "payments", "app.kubernetes.io/version": "v2"},
+		},
+		{
+			name:  "deleted owner",
+			owner: &metav1.OwnerReference{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "gone"},
+			want:  map[string]string{},
+		},
+		{
+			name:  "unsupported kind",
+			owner: &metav1.OwnerReference{APIVersion: "example.com/v1", Kind: "Rollout", Name: "web"},
+			want:  map[string]string{},
+		},
+		{name: "no owner", want: map[string]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := wh.ownerLabels(context.Background(), "apps", tt.owner)
+			if err != nil {
+				t.Fatalf("ownerLabels: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ownerLabels = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+
+	jsonpatch "github.com/evanphx/json-patch"
+)
+
+// checkPatch applies patch to the original object JSON, as the API server
+// would, and verifies the pod at root (see decodePod) still decodes and
+// carries every applied key/value in its labels, or its annotations when
+// injectAs is injectAsAnnotations. It catches pointer escaping and op
+// selection bugs before the API server does.
+func checkPatch(original, patch []byte, root, injectAs string, applied map[string]string) error {
+	decoded, err := jsonpatch.DecodePatch(patch)
+	if err != nil {
+		return fmt.Errorf("decoding patch: %w", err)
+	}
+	patched, err := decoded.Apply(original)
+	if err != nil {
+		return fmt.Errorf("applying patch: %w", err)
+	}
+
+	pod, err := decodePod(patched, root, false)
+	if err != nil {
+		return fmt.Errorf("decoding patched pod: %w", err)
+	}
+	got := pod.Labels
+	if injectAs == injectAsAnnotations {
+		got = pod.Annotations
+	}
+	for key, value := range applied {
+		if actual, ok := got[key]; !ok || actual != value {
+			return fmt.Errorf("patched pod has %s %q=%q, want %q", injectAs, key, actual, value)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+// defaultPprofPort is used when PPROF_PORT is unset.
+const defaultPprofPort = "6060"
+
+// startPprofServer serves the pprof handlers under /debug/pprof/ on
+// localhost:port in the background. It is plain HTTP and separate from the
+// admission server, so profiles are only reachable from inside the pod.
+func startPprofServer(port string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	server := &http.Server{Addr: net.JoinHostPort("localhost", port), Handler: mux}
+	go func() {
+		slog.Info("Starting pprof server", "addr", server.Addr)
+		// A profiling failure should not take down admission.
+		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("pprof server stopped", "error", err)
+		}
+	}()
+}
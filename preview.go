@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// previewUID identifies the synthetic admission requests built by /preview in
+// logs.
+const previewUID = "preview"
+
+// previewKey is the context key marking a mutate call made by /preview.
+type previewKey struct{}
+
+// withPreview marks ctx as belonging to a preview.
+func withPreview(ctx context.Context) context.Context {
+	return context.WithValue(ctx, previewKey{}, true)
+}
+
+// isPreview reports whether ctx belongs to a preview, whose outcome must
+// not be counted as an admission.
+func isPreview(ctx context.Context) bool {
+	preview, _ := ctx.Value(previewKey{}).(bool)
+	return preview
+}
+
+// ServePreview runs the mutation logic on a raw Pod manifest, rather than an
+// AdmissionReview, and returns the JSON patch it would apply ("[]" for none),
+// or the same as YAML if the Accept header asks for it. The pod's namespace
+// is taken from its metadata, or the namespace query parameter, defaulting
+// to "default"; it must exist. The request is handled as a dry-run CREATE,
+// so no events are recorded, and it is left out of the admission metrics.
+// Warnings are returned as Warning headers; a denial is reported as a 422
+// JSON error carrying the denial message.
+func (wh *Webhook) ServePreview(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed, use POST")
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, wh.config.MaxBodyBytes))
+	defer r.Body.Close()
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body exceeds %d bytes", maxBytesErr.Limit))
+		return
+	}
+	if err != nil || len(body) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "Empty request body")
+		return
+	}
+
+	var pod corev1.Pod
+	if err := json.Unmarshal(body, &pod); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Could not unmarshal Pod: "+err.Error())
+		return
+	}
+	namespace := pod.Namespace
+	if ns := r.URL.Query().Get("namespace"); ns != "" {
+		namespace = ns
+	}
+	if namespace == "" {
+		namespace = metav1.NamespaceDefault
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), wh.config.HandlerTimeout)
+	defer cancel()
+
+	// Only previews for real namespaces reach the label source, whose cache
+	// is keyed by namespace.
+	if _, err := wh.namespaces.Get(ctx, namespace); err != nil {
+		if apierrors.IsNotFound(err) {
+			writeJSONError(w, http.StatusUnprocessableEntity, fmt.Sprintf("Namespace %q not found", namespace))
+			return
+		}
+		wh.logger.Error("Could not look up preview namespace", "namespace", namespace, "error", err)
+		writeJSONError(w, http.StatusServiceUnavailable, "Could not look up namespace")
+		return
+	}
+
+	dryRun := true
+	review := &admissionv1.AdmissionReview{
+		Request: &admissionv1.AdmissionRequest{
+			UID:       previewUID,
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+			Name:      pod.Name,
+			Namespace: namespace,
+			Operation: admissionv1.Create,
+			Object:    runtime.RawExtension{Raw: body},
+			DryRun:    &dryRun,
+		},
+	}
+
+	resp := wh.mutate(withPreview(ctx), review)
+
+	for _, warning := range resp.Warnings {
+		w.Header().Add("Warning", "299 - "+strconv.Quote(warning))
+	}
+	if !resp.Allowed {
+		writeJSONError(w, http.StatusUnprocessableEntity, resultMessage(resp))
+		return
+	}
+
+	patch := resp.Patch
+	if len(patch) == 0 {
+		patch = []byte("[]")
+	}
+	writeNegotiated(w, r, "application/json-patch+json", patch)
+}
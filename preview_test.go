@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestServePreview(t *testing.T) {
+	apps := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "apps"}}
+	body, err := json.Marshal(testPod(map[string]string{targetLabel: "abc"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		namespace string
+		want      int
+	}{
+		{"existing namespace", "apps", http.StatusOK},
+		{"unknown namespace", "no-such-namespace", http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := &fakeLabelSource{labels: map[string]string{"team": "payments"}}
+			wh := newTestWebhook(t, testConfig(t), source, apps)
+
+			r := httptest.NewRequest(http.MethodPost, "/preview?namespace="+tt.namespace, bytes.NewReader(body))
+			w := httptest.NewRecorder()
+			wh.ServePreview(w, r)
+
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if tt.want != http.StatusOK && source.calls != 0 {
+				t.Errorf("label source called %d times for an unknown namespace", source.calls)
+			}
+			// Previews must not use up namespace metric labels.
+			if len(wh.namespaceMetrics.seen) != 0 {
+				t.Errorf("namespace metrics recorded %v for a preview", wh.namespaceMetrics.seen)
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.12
+// 	protoc        (unknown)
+// source: labels/v1/labels.proto
+
+package labelsv1
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type GetLabelsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Namespace     string                 `protobuf:"bytes,1,opt,name=namespace,proto3" json:"namespace,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetLabelsRequest) Reset() {
+	*x = GetLabelsRequest{}
+	mi := &file_labels_v1_labels_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetLabelsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetLabelsRequest) ProtoMessage() {}
+
+func (x *GetLabelsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_labels_v1_labels_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetLabelsRequest.ProtoReflect.Descriptor instead.
+func (*GetLabelsRequest) Descriptor() ([]byte, []int) {
+	return file_labels_v1_labels_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *GetLabelsRequest) GetNamespace() string {
+	if x != nil {
+		return x.Namespace
+	}
+	return ""
+}
+
+type GetLabelsResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Labels        map[string]string      `protobuf:"bytes,1,rep,name=labels,proto3" json:"labels,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetLabelsResponse) Reset() {
+	*x = GetLabelsResponse{}
+	mi := &file_labels_v1_labels_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetLabelsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetLabelsResponse) ProtoMessage() {}
+
+func (x *GetLabelsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_labels_v1_labels_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetLabelsResponse.ProtoReflect.Descriptor instead.
+func (*GetLabelsResponse) Descriptor() ([]byte, []int) {
+	return file_labels_v1_labels_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *GetLabelsResponse) GetLabels() map[string]string {
+	if x != nil {
+		return x.Labels
+	}
+	return nil
+}
+
+var File_labels_v1_labels_proto protoreflect.FileDescriptor
+
+const file_labels_v1_labels_proto_rawDesc = "" +
+	"\n" +
+	"\x16labels/v1/labels.proto\x12\tlabels.v1\"0\n" +
+	"\x10GetLabelsRequest\x12\x1c\n" +
+	"\tnamespace\x18\x01 \x01(\tR\tnamespace\"\x90\x01\n" +
+	"\x11GetLabelsResponse\x12@\n" +
+	"\x06labels\x18\x01 \x03(\v2(.labels.v1.GetLabelsResponse.LabelsEntryR\x06labels\x1a9\n" +
+	"\vLabelsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x012V\n" +
+	"\fLabelService\x12F\n" +
+	"\tGetLabels\x12\x1b.labels.v1.GetLabelsRequest\x1a\x1c.labels.v1.GetLabelsResponseBFZDgithub.com/david-serrano-realtor/webhookPOC/proto/labels/v1;labelsv1b\x06proto3"
+
+var (
+	file_labels_v1_labels_proto_rawDescOnce sync.Once
+	file_labels_v1_labels_proto_rawDescData []byte
+)
+
+func file_labels_v1_labels_proto_rawDescGZIP() []byte {
+	file_labels_v1_labels_proto_rawDescOnce.Do(func() {
+		file_labels_v1_labels_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_labels_v1_labels_proto_rawDesc), len(file_labels_v1_labels_proto_rawDesc)))
+	})
+	return file_labels_v1_labels_proto_rawDescData
+}
+
+var file_labels_v1_labels_proto_msgTypes = make([]protoimpl.MessageInfo, 3)
+var file_labels_v1_labels_proto_goTypes = []any{
+	(*GetLabelsRequest)(nil),  // 0: labels.v1.GetLabelsRequest
+	(*GetLabelsResponse)(nil), // 1: labels.v1.GetLabelsResponse
+	nil,                       // 2: labels.v1.GetLabelsResponse.LabelsEntry
+}
+var file_labels_v1_labels_proto_depIdxs = []int32{
+	2, // 0: labels.v1.GetLabelsResponse.labels:type_name -> labels.v1.GetLabelsResponse.LabelsEntry
+	0, // 1: labels.v1.LabelService.GetLabels:input_type -> labels.v1.GetLabelsRequest
+	1, // 2: labels.v1.LabelService.GetLabels:output_type -> labels.v1.GetLabelsResponse
+	2, // [2:3] is the sub-list for method output_type
+	1, // [1:2] is the sub-list for method input_type
+	1, // [1:1] is the sub-list for extension type_name
+	1, // [1:1] is the sub-list for extension extendee
+	0, // [0:1] is the sub-list for field type_name
+}
+
+func init() { file_labels_v1_labels_proto_init() }
+func file_labels_v1_labels_proto_init() {
+	if File_labels_v1_labels_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_labels_v1_labels_proto_rawDesc), len(file_labels_v1_labels_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   3,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_labels_v1_labels_proto_goTypes,
+		DependencyIndexes: file_labels_v1_labels_proto_depIdxs,
+		MessageInfos:      file_labels_v1_labels_proto_msgTypes,
+	}.Build()
+	File_labels_v1_labels_proto = out.File
+	file_labels_v1_labels_proto_goTypes = nil
+	file_labels_v1_labels_proto_depIdxs = nil
+}
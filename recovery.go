@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// reviewIDKey is the context key under which recoverAdmission stores the
+// *reviewID of the request being handled.
+type reviewIDKey struct{}
+
+// reviewID identifies the AdmissionReview being handled, so a response can be
+// addressed to it even after a panic. readAdmissionReview fills it in.
+type reviewID struct {
+	apiVersion string
+	uid        types.UID
+}
+
+// recoverAdmission wraps an admission handler so a panic is answered with a
+// well-formed AdmissionReview error and a 500, rather than a reset
+// connection that leaves the outcome to the webhook's failurePolicy.
+func (wh *Webhook) recoverAdmission(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := &reviewID{apiVersion: admissionv1.SchemeGroupVersion.String()}
+		r = r.WithContext(context.WithValue(r.Context(), reviewIDKey{}, id))
+
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			// The server aborts the response on purpose with this one.
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+			wh.logger.Error("Panic handling admission request", "uid", id.uid, "panic", fmt.Sprint(recovered), "stack", string(debug.Stack()))
+			wh.writeAdmissionError(w, http.StatusInternalServerError, id.apiVersion, id.uid, "Internal error handling admission request")
+		}()
+
+		next(w, r)
+	}
+}
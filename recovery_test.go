@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+// panickingLabelSource panics on every fetch.
+type panickingLabelSource struct{}
+
+func (panickingLabelSource) Fetch(context.Context, string) (map[string]string, error) {
+	panic("label source bug")
+}
+
+func TestRecoverAdmissionPanic(t *testing.T) {
+	wh := newTestWebhook(t, testConfig(t), panickingLabelSource{})
+	body, err := json.Marshal(podReview(t, testPod(map[string]string{targetLabel: "abc"}), admissionv1.Create))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, review := serveReview(t, wh, body)
+
+	if code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", code, http.StatusInternalServerError)
+	}
+	if review.APIVersion != admissionv1.SchemeGroupVersion.String() || review.Kind != "AdmissionReview" {
+		t.Errorf("review type = %s %s, want an admission.k8s.io/v1 AdmissionReview", review.APIVersion, review.Kind)
+	}
+	if review.Response == nil || review.Response.Allowed {
+		t.Fatalf("response = %+v, want a denial", review.Response)
+	}
+	if review.Response.UID != "test-uid" {
+		t.Errorf("UID = %q, want %q", review.Response.UID, "test-uid")
+	}
+}
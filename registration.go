@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// Defaults for self-registration, used when the corresponding
+// SELF_REGISTER_* variable is unset.
+const (
+	defaultWebhookConfigName  = "label-webhook"
+	defaultWebhookServiceName = "label-webhook"
+	defaultWebhookServicePort = 443
+)
+
+// maxWebhookTimeoutSeconds is the largest timeoutSeconds the API server
+// accepts; the smallest is 1.
+const maxWebhookTimeoutSeconds = 30
+
+// webhookConfiguration builds the MutatingWebhookConfiguration routing the
+// configured operations on pods, and the enabled workload kinds, to /mutate
+// on the webhook's Service. Objects in the webhook's own namespace and the
+// excluded namespaces are not sent to it.
+func webhookConfiguration(cfg Config, serviceNamespace string, caBundle []byte) *admissionregistrationv1.MutatingWebhookConfiguration {
+	operations := make([]admissionregistrationv1.OperationType, 0, len(cfg.HandleOperations))
+	for _, op := range cfg.HandleOperations {
+		operations = append(operations, admissionregistrationv1.OperationType(op))
+	}
+	rules := []admissionregistrationv1.RuleWithOperations{{
+		Operations: operations,
+		Rule: admissionregistrationv1.Rule{
+			APIGroups:   []string{""},
+			APIVersions: []string{"v1"},
+			Resources:   []string{"pods"},
+		},
+	}}
+	if len(cfg.WorkloadKinds) > 0 {
+		resources := make([]string, 0, len(cfg.WorkloadKinds))
+		for _, kind := range cfg.WorkloadKinds {
+			resources = append(resources, strings.ToLower(kind)+"s")
+		}
+		rules = append(rules, admissionregistrationv1.RuleWithOperations{
+			Operations: operations,
+			Rule: admissionregistrationv1.Rule{
+				APIGroups:   []string{"apps"},
+				APIVersions: []string{"v1"},
+				Resources:   resources,
+			},
+		})
+	}
+
+	path := "/mutate"
+	port := int32(cfg.WebhookServicePort)
+	// Events are the only side effect, and dry runs skip them.
+	sideEffects := admissionregistrationv1.SideEffectClassNoneOnDryRun
+	failurePolicy := admissionregistrationv1.Fail
+	if cfg.FailOpen {
+		failurePolicy = admissionregistrationv1.Ignore
+	}
+	timeoutSeconds := int32(min(max(cfg.HandlerTimeout.Seconds(), 1), maxWebhookTimeoutSeconds))
+	// The webhook must not gate its own pods: with failurePolicy Fail, a
+	// replacement for a dead webhook pod could never be admitted.
+	skipNamespaces := []string{serviceNamespace}
+	for _, namespace := range cfg.ExcludedNamespaces {
+		if !slices.Contains(skipNamespaces, namespace) {
+			skipNamespaces = append(skipNamespaces, namespace)
+		}
+	}
+	namespaceSelector := &metav1.LabelSelector{
+		MatchExpressions: []metav1.LabelSelectorRequirement{{
+			Key:      corev1.LabelMetadataName,
+			Operator: metav1.LabelSelectorOpNotIn,
+			Values:   skipNamespaces,
+		}},
+	}
+
+	return &admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: cfg.WebhookConfigName},
+		Webhooks: []admissionregistrationv1.MutatingWebhook{{
+			Name: cfg.WebhookConfigName + ".webhook.example.com",
+			ClientConfig: admissionregistrationv1.WebhookClientConfig{
+				Service: &admissionregistrationv1.ServiceReference{
+					Namespace: serviceNamespace,
+					Name:      cfg.WebhookServiceName,
+					Path:      &path,
+					Port:      &port,
+				},
+				CABundle: caBundle,
+			},
+			Rules:                   rules,
+			NamespaceSelector:       namespaceSelector,
+			AdmissionReviewVersions: []string{"v1", "v1beta1"},
+			SideEffects:             &sideEffects,
+			FailurePolicy:           &failurePolicy,
+			TimeoutSeconds:          &timeoutSeconds,
+		}},
+	}
+}
+
+// registerWebhook creates the webhook's MutatingWebhookConfiguration, or
+// updates it if it already exists, trusting the CA bundle read from
+// caBundleFile.
+func registerWebhook(ctx context.Context, client kubernetes.Interface, cfg Config, caBundleFile string) error {
+	caBundle, err := os.ReadFile(caBundleFile)
+	if err != nil {
+		return fmt.Errorf("reading CA bundle: %w", err)
+	}
+	serviceNamespace := cfg.WebhookServiceNamespace
+	if serviceNamespace == "" {
+		if serviceNamespace, err = ownNamespace(); err != nil {
+			return fmt.Errorf("%w; set SELF_REGISTER_SERVICE_NAMESPACE", err)
+		}
+	}
+
+	desired := webhookConfiguration(cfg, serviceNamespace, caBundle)
+	configs := client.AdmissionregistrationV1().MutatingWebhookConfigurations()
+	// Replicas starting together race to create or update the
+	// configuration; the losers retry against the winner's.
+	retriable := func(err error) bool {
+		return apierrors.IsAlreadyExists(err) || apierrors.IsConflict(err)
+	}
+	return retry.OnError(retry.DefaultRetry, retriable, func() error {
+		existing, err := configs.Get(ctx, desired.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			_, err = configs.Create(ctx, desired, metav1.CreateOptions{})
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		existing.Webhooks = desired.Webhooks
+		_, err = configs.Update(ctx, existing, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// unregisterWebhook deletes the webhook's MutatingWebhookConfiguration. A
+// configuration that is already gone is not an error.
+func unregisterWebhook(ctx context.Context, client kubernetes.Interface, name string) error {
+	err := client.AdmissionregistrationV1().MutatingWebhookConfigurations().Delete(ctx, name, metav1.DeleteOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// checkCABundle verifies that every webhook in the named
+// MutatingWebhookConfiguration has a caBundle the serving certificate in
+// certFile/keyFile chains to. It returns a description of each mismatch.
+func checkCABundle(ctx context.Context, client kubernetes.Interface, name, certFile, keyFile string) ([]string, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading serving certificate: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("parsing serving certificate: %w", err)
+	}
+	intermediates := x509.NewCertPool()
+	for _, der := range cert.Certificate[1:] {
+		if c, err := x509.ParseCertificate(der); err == nil {
+			intermediates.AddCert(c)
+		}
+	}
+
+	config, err := client.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("getting MutatingWebhookConfiguration %s: %w", name, err)
+	}
+
+	var mismatches []string
+	for _, webhook := range config.Webhooks {
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(webhook.ClientConfig.CABundle) {
+			mismatches = append(mismatches, fmt.Sprintf("webhook %s has no usable caBundle", webhook.Name))
+			continue
+		}
+		_, err := leaf.Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+		if err != nil {
+			mismatches = append(mismatches, fmt.Sprintf("webhook %s caBundle does not verify the serving certificate: %v", webhook.Name, err))
+		}
+	}
+	return mismatches, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestWebhookConfigurationSkipsOwnNamespace(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.ExcludedNamespaces = []string{"kube-system", "webhook"}
+
+	config := webhookConfiguration(cfg, "webhook", []byte("ca"))
+
+	want := &metav1.LabelSelector{
+		MatchExpressions: []metav1.LabelSelectorRequirement{{
+			Key:      corev1.LabelMetadataName,
+			Operator: metav1.LabelSelectorOpNotIn,
+			Values:   []string{"webhook", "kube-system"},
+		}},
+	}
+	if got := config.Webhooks[0].NamespaceSelector; !reflect.DeepEqual(got, want) {
+		t.Errorf("NamespaceSelector = %+v, want %+v", got, want)
+	}
+}
+
+func TestRegisterWebhookLosingCreateRace(t *testing.T) {
+	caBundleFile := filepath.Join(t.TempDir(), "ca.crt")
+	if err := os.WriteFile(caBundleFile, []byte("new-ca"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig(t)
+	cfg.WebhookServiceNamespace = "webhook"
+
+	// Another replica created the configuration between our Get and Create.
+	client := fake.NewSimpleClientset(webhookConfiguration(cfg, "webhook", []byte("old-ca")))
+	hidden := true
+	client.PrependReactor("get", "mutatingwebhookconfigurations", func(k8stesting.Action) (bool, runtime.Object, error) {
+		if hidden {
+			hidden = false
+			return true, nil, apierrors.NewNotFound(admissionregistrationv1.Resource("mutatingwebhookconfigurations"), cfg.WebhookConfigName)
+		}
+		return false, nil, nil
+	})
+
+	if err := registerWebhook(context.Background(), client, cfg, caBundleFile); err != nil {
+		t.Fatalf("registerWebhook: %v", err)
+	}
+
+	got, err := client.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(context.Background(), cfg.WebhookConfigName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ca := string(got.Webhooks[0].ClientConfig.CABundle); ca != "new-ca" {
+		t.Errorf("caBundle = %q, want the updated %q", ca, "new-ca")
+	}
+}
+
+func TestCheckCABundle(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, dir, "ca", "test CA", true, nil)
+	serving := newTestCert(t, dir, "tls", "localhost", false, ca)
+	other := newTestCert(t, dir, "other", "other CA", true, nil)
+	caPEM, err := os.ReadFile(ca.certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPEM, err := os.ReadFile(other.certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := testConfig(t)
+	config := webhookConfiguration(cfg, "webhook", caPEM)
+	matching := config.Webhooks[0]
+	mismatched := *matching.DeepCopy()
+	mismatched.Name = "mismatched.example.com"
+	mismatched.ClientConfig.CABundle = otherPEM
+	empty := *matching.DeepCopy()
+	empty.Name = "empty.example.com"
+	empty.ClientConfig.CABundle = nil
+	config.Webhooks = append(config.Webhooks, mismatched, empty)
+	client := fake.NewSimpleClientset(config)
+
+	mismatches, err := checkCABundle(context.Background(), client, cfg.WebhookConfigName, serving.certFile, serving.keyFile)
+	if err != nil {
+		t.Fatalf("checkCABundle: %v", err)
+	}
+	if len(mismatches) != 2 {
+		t.Fatalf("mismatches = %q, want one each for %s and %s", mismatches, mismatched.Name, empty.Name)
+	}
+	if !strings.Contains(mismatches[0], mismatched.Name) || !strings.Contains(mismatches[0], "does not verify") {
+		t.Errorf("mismatches[0] = %q, want %s reported as not verifying", mismatches[0], mismatched.Name)
+	}
+	if !strings.Contains(mismatches[1], empty.Name) || !strings.Contains(mismatches[1], "no usable caBundle") {
+		t.Errorf("mismatches[1] = %q, want %s reported as having no caBundle", mismatches[1], empty.Name)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// labelTemplateData is what label templates are evaluated against, e.g.
+// {{ .Namespace }} or {{ index .Labels "app" }}.
+type labelTemplateData struct {
+	Namespace    string
+	Name         string
+	GenerateName string
+	Labels       map[string]string
+	Annotations  map[string]string
+	// OwnerKind and OwnerName identify the pod's controller, if any.
+	OwnerKind string
+	OwnerName string
+}
+
+// parseLabelTemplates compiles a map of label key to Go template source.
+// Missing map keys render as empty strings rather than "<no value>".
+func parseLabelTemplates(sources map[string]string) (map[string]*template.Template, error) {
+	templates := make(map[string]*template.Template, len(sources))
+	for key, source := range sources {
+		tmpl, err := template.New(key).Option("missingkey=zero").Parse(source)
+		if err != nil {
+			return nil, fmt.Errorf("label %q: %w", key, err)
+		}
+		templates[key] = tmpl
+	}
+	return templates, nil
+}
+
+// renderLabelTemplates evaluates the templates against pod in namespace. It
+// returns the labels that rendered and an error for each that failed.
+func renderLabelTemplates(templates map[string]*template.Template, namespace string, pod *corev1.Pod) (map[string]string, []error) {
+	data := labelTemplateData{
+		Namespace:    namespace,
+		Name:         pod.Name,
+		GenerateName: pod.GenerateName,
+		Labels:       pod.Labels,
+		Annotations:  pod.Annotations,
+	}
+	if owner := metav1.GetControllerOf(pod); owner != nil {
+		data.OwnerKind, data.OwnerName = owner.Kind, owner.Name
+	}
+
+	rendered := make(map[string]string, len(templates))
+	var errs []error
+	for key, tmpl := range templates {
+		var value strings.Builder
+		if err := tmpl.Execute(&value, data); err != nil {
+			errs = append(errs, fmt.Errorf("label %q: %w", key, err))
+			continue
+		}
+		rendered[key] = value.String()
+	}
+	return rendered, errs
+}
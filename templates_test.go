@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestMutateLabelTemplates(t *testing.T) {
+	t.Setenv("LABEL_TEMPLATES", `env={{ .Namespace }}-env,app-copy={{ index .Labels "app" }},owner={{ .OwnerKind }}-{{ .OwnerName }},team={{ .Name }}`)
+	wh := newTestWebhook(t, testConfig(t), &fakeLabelSource{labels: map[string]string{"team": "payments"}})
+	isController := true
+	pod := testPod(map[string]string{targetLabel: "abc", "app": "checkout"})
+	pod.OwnerReferences = []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "web-5d8f", Controller: &isController}}
+
+	resp := wh.mutate(context.Background(), podReview(t, pod, admissionv1.Create))
+
+	if !resp.Allowed {
+		t.Fatalf("mutate denied the request: %s", resultMessage(resp))
+	}
+	// The fetched team wins over the templated one.
+	want := []patchOp{
+		{Op: "add", Path: "/metadata/labels/app-copy", Value: "checkout"},
+		{Op: "add", Path: "/metadata/labels/env", Value: "apps-env"},
+		{Op: "add", Path: "/metadata/labels/owner", Value: "ReplicaSet-web-5d8f"},
+		{Op: "add", Path: "/metadata/labels/team", Value: "payments"},
+		{Op: "add", Path: "/metadata/annotations", Value: map[string]interface{}{}},
+		{Op: "add", Path: markerPath, Value: ""},
+	}
+	if got := decodePatch(t, resp); !reflect.DeepEqual(got, want) {
+		t.Errorf("patch = %+v, want %+v", got, want)
+	}
+}
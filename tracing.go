@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// tracer creates the webhook's spans. It is a no-op until setupTracing
+// installs a provider.
+var tracer = otel.Tracer("label-webhook")
+
+// setupTracing exports spans over OTLP/gRPC to endpoint, when set, which
+// comes from OTEL_EXPORTER_OTLP_ENDPOINT; the exporter reads the other
+// standard OTEL_* environment variables itself. Otherwise tracing stays a
+// no-op. The returned function flushes pending spans and must be called on
+// shutdown.
+func setupTracing(ctx context.Context, endpoint string) (func(context.Context) error, error) {
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracegrpc.New(ctx, otlptracegrpc.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(eventComponent))),
+	)
+	otel.SetTracerProvider(provider)
+	// Continue the API server's trace, and pass it on to the label API.
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
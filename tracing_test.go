@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+func TestServeMutateSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	oldTracer := tracer
+	t.Cleanup(func() { tracer = oldTracer })
+	tracer = provider.Tracer("label-webhook")
+
+	wh := newTestWebhook(t, testConfig(t), &fakeLabelSource{labels: map[string]string{"team": "payments"}})
+	body, err := json.Marshal(podReview(t, testPod(map[string]string{targetLabel: "abc"}), admissionv1.Create))
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveReview(t, wh, body)
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	// Each span's expected parent.
+	for name, parent := range map[string]string{"parse": "admission", "mutate": "admission", "fetch-labels": "mutate"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("no %q span recorded", name)
+			continue
+		}
+		if spans[parent] == nil || span.Parent().SpanID() != spans[parent].SpanContext().SpanID() {
+			t.Errorf("%q span is not a child of %q", name, parent)
+		}
+	}
+	if _, ok := spans["admission"]; !ok {
+		t.Error("no \"admission\" span recorded")
+	}
+}
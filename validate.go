@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ServeValidate handles the AdmissionReview request for the validating
+// webhook.
+func (wh *Webhook) ServeValidate(w http.ResponseWriter, r *http.Request) {
+	reviewReq, ok := wh.readAdmissionReview(w, r)
+	if !ok {
+		return
+	}
+
+	response := wh.validate(r.Context(), reviewReq)
+
+	wh.writeAdmissionResponse(w, reviewReq.APIVersion, reviewReq.Request.UID, response)
+}
+
+// validate denies pods carrying any of the forbidden labels. Each entry is
+// either a label key, which matches any value, or a key=value pair.
+func (wh *Webhook) validate(ctx context.Context, ar *admissionv1.AdmissionReview) (resp *admissionv1.AdmissionResponse) {
+	req := ar.Request
+	logger := wh.requestLogger(req)
+	defer func() {
+		logger.InfoContext(ctx, "Validation decision", "decision", decision(resp), "message", resultMessage(resp))
+	}()
+
+	// Only handle the pods resource itself, not its subresources.
+	if !isPodRequest(req) {
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+
+	// DELETE requests carry no object; there is nothing to check.
+	if len(req.Object.Raw) == 0 {
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+
+	var pod corev1.Pod
+	if err := unmarshalJSON(req.Object.Raw, &pod, wh.config.StrictDecode); err != nil {
+		return &admissionv1.AdmissionResponse{
+			Allowed: false,
+			Result:  &metav1.Status{Message: "Could not unmarshal Pod: " + err.Error()},
+		}
+	}
+	logger = logger.With("pod", podName(&pod), "owner", podOwner(&pod))
+
+	if entry, found := findForbiddenLabel(pod.Labels, wh.config.ForbiddenLabels); found {
+		return &admissionv1.AdmissionResponse{
+			Allowed: false,
+			Result: &metav1.Status{
+				Message: fmt.Sprintf("Pod carries forbidden label %q; remove it from the pod template", entry),
+				Reason:  reasonForbiddenLabel,
+				Code:    http.StatusForbidden,
+			},
+		}
+	}
+
+	return &admissionv1.AdmissionResponse{Allowed: true}
+}
+
+// findForbiddenLabel returns the first forbidden entry matched by labels.
+func findForbiddenLabel(labels map[string]string, forbiddenLabels []string) (string, bool) {
+	for _, entry := range forbiddenLabels {
+		key, value, hasValue := strings.Cut(entry, "=")
+		actual, exists := labels[key]
+		if exists && (!hasValue || actual == value) {
+			return entry, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Build information, set at build time with e.g.
+//
+//	go build -ldflags "-X main.version=v1.2.3 -X main.gitCommit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	version   = "dev"
+	gitCommit = "unknown"
+	buildDate = "unknown"
+)
+
+// serveVersion reports the build information as JSON, or YAML on request.
+func serveVersion(w http.ResponseWriter, r *http.Request) {
+	body, _ := json.Marshal(map[string]string{
+		"version":   version,
+		"gitCommit": gitCommit,
+		"buildDate": buildDate,
+	})
+	writeNegotiated(w, r, "application/json", body)
+}
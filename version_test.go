@@ -0,0 +1,27 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestServeVersion(t *testing.T) {
+	oldVersion, oldCommit, oldDate := version, gitCommit, buildDate
+	t.Cleanup(func() { version, gitCommit, buildDate = oldVersion, oldCommit, oldDate })
+	version, gitCommit, buildDate = "v1.2.3", "0123abc", "2026-01-02T03:04:05Z"
+
+	w := httptest.NewRecorder()
+	serveVersion(w, httptest.NewRequest(http.MethodGet, "/version", nil))
+
+	var got map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decoding body %q: %v", w.Body, err)
+	}
+	want := map[string]string{"version": "v1.2.3", "gitCommit": "0123abc", "buildDate": "2026-01-02T03:04:05Z"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("body = %v, want %v", got, want)
+	}
+}
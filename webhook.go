@@ -1,77 +1,432 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"maps"
+	"mime"
+	"net"
 	"net/http"
-	"os"
+	"os/signal"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
 	admissionv1 "k8s.io/api/admission/v1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"sigs.k8s.io/yaml"
 )
 
+// supportedReviewVersions are the AdmissionReview versions the webhook
+// accepts. v1beta1 has the same wire format as v1 for every field used here,
+// so both decode into the v1 types, and responses mirror the request's
+// version.
+var supportedReviewVersions = []string{
+	admissionv1.SchemeGroupVersion.String(),
+	admissionv1beta1.SchemeGroupVersion.String(),
+}
+
+// readyzTimeout bounds the API server check made by /readyz.
+const readyzTimeout = 2 * time.Second
+
+// Reasons set on denials, so clients can tell failure classes apart without
+// parsing messages.
+const (
+	reasonLabelFetchFailed metav1.StatusReason = "label-fetch-failed"
+	reasonInvalidLabel     metav1.StatusReason = "invalid-label"
+	reasonForbiddenLabel   metav1.StatusReason = "forbidden-label"
+)
+
+// mutatedAnnotation records when the webhook last changed a pod, as an
+// RFC 3339 timestamp.
+const mutatedAnnotation = "webhook.example.com/mutated"
+
+// removedLabelsAnnotation lists, comma-separated, the injected keys a user
+// removed from a pod on UPDATE. The webhook does not re-add them.
+const removedLabelsAnnotation = "webhook.example.com/removed-labels"
+
 func main() {
-	config, err := rest.InClusterConfig()
+	loadFileSettings()
+	setupLogging()
+	slog.Info("Starting label webhook", "version", version, "gitCommit", gitCommit, "buildDate", buildDate)
+	cfg := loadConfig()
+	warnUnknownSettings()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	restConfig, err := rest.InClusterConfig()
 	if err != nil {
-		log.Fatalf("Error creating in-cluster config: %v", err)
+		fatal("Error creating in-cluster config", "error", err)
 	}
 
-	clientset, err := kubernetes.NewForConfig(config)
+	clientset, err := kubernetes.NewForConfig(restConfig)
 	if err != nil {
-		log.Fatalf("Error creating clientset: %v", err)
+		fatal("Error creating clientset", "error", err)
 	}
 
-	// Set up the HTTP handler.
-	http.HandleFunc("/mutate", func(w http.ResponseWriter, r *http.Request) {
-		serveMutate(w, r, clientset)
-	})
+	if cfg.TargetLabelMatch == targetLabelMatchRegex {
+		slog.Info("Targeting pods by label key", "match", cfg.TargetLabelMatch, "pattern", cfg.TargetLabelPattern.String())
+	} else {
+		slog.Info("Targeting pods by label key", "match", cfg.TargetLabelMatch, "targets", cfg.TargetLabelPrefixes)
+	}
+	switch cfg.LabelSourceType {
+	case labelSourceHTTP:
+		slog.Info("Using the label API", "url", cfg.LabelAPIURL)
+	case labelSourceGRPC:
+		slog.Info("Using the gRPC label service", "addr", cfg.LabelGRPCAddr)
+	case labelSourceMock:
+		slog.Info("Using mock labels", "mockLabels", cfg.MockLabels)
+	default:
+		slog.Info("Using label source", "type", cfg.LabelSourceType)
+	}
+	if len(cfg.ExcludedNamespaces) > 0 {
+		slog.Info("Skipping excluded namespaces", "namespaces", cfg.ExcludedNamespaces)
+	}
+	if cfg.ForceDeny {
+		slog.Warn("FORCE_DENY IS ENABLED: every matching pod will be denied. This is a test mode, never use it in production.", "message", cfg.ForceDenyMessage)
+	}
+	if len(cfg.ForbiddenLabels) > 0 {
+		slog.Info("Denying pods with forbidden labels", "forbiddenLabels", cfg.ForbiddenLabels)
+	}
+
+	labelSource, closeLabelSource, err := newLabelSource(ctx, cfg, clientset)
+	if err != nil {
+		fatal("Error creating label source", "error", err)
+	}
+
+	wh, err := NewWebhook(clientset, labelSource, cfg, slog.Default())
+	if err != nil {
+		fatal("Error creating webhook", "error", err)
+	}
+
+	// Set up the HTTP handlers. They use their own mux, not
+	// http.DefaultServeMux, because importing net/http/pprof registers the
+	// profiling handlers on the default one.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mutate", wh.requireClientCert(wh.recoverAdmission(wh.ServeMutate)))
+	mux.HandleFunc("/validate", wh.requireClientCert(wh.recoverAdmission(wh.ServeValidate)))
+	mux.HandleFunc("/preview", wh.ServePreview)
+	mux.HandleFunc("/healthz", serveHealthz)
+	mux.HandleFunc("/readyz", wh.ServeReadyz)
+	mux.HandleFunc("/version", serveVersion)
+	mux.HandleFunc("/stats", serveStats)
+	// The config names internal endpoints and files, so it is opt-in.
+	if cfg.EnableConfigEndpoint {
+		mux.HandleFunc("/config", wh.ServeConfig)
+	}
+	// With TLS enabled the server only speaks TLS, so Prometheus must scrape
+	// /metrics with scheme https. The scrape carries no admission payload, so
+	// the serving cert need not be trusted (insecure_skip_verify is fine).
+	mux.Handle("/metrics", promhttp.Handler())
+
+	server := &http.Server{Addr: listenAddress(cfg), Handler: mux}
+
+	if cfg.EnablePprof {
+		startPprofServer(cfg.PprofPort)
+	}
+	wh.startDrainServer(cfg.DrainPort)
+
+	if cfg.TLSEnabled {
+		// Secrets mounted under other key names are found by searching
+		// TLS_DIR.
+		if cfg.TLSDir != "" && (!fileExists(cfg.TLSCertFile) || !fileExists(cfg.TLSKeyFile)) {
+			certFile, keyFile, err := findCertPair(cfg.TLSDir)
+			if err != nil {
+				fatal("Error finding TLS certificate", "dir", cfg.TLSDir, "error", err)
+			}
+			slog.Info("Using TLS certificate found in TLS_DIR", "certFile", certFile, "keyFile", keyFile)
+			cfg.TLSCertFile, cfg.TLSKeyFile = certFile, keyFile
+		}
+		tlsConfig, err := serverTLSConfig(cfg)
+		if err != nil {
+			fatal("Error setting up TLS", "error", err)
+		}
+		server.TLSConfig = tlsConfig
+		if cfg.ClientCAFile != "" {
+			slog.Info("Requiring client certificates on admission endpoints", "clientCAFile", cfg.ClientCAFile)
+		}
+	} else {
+		// The API server only calls webhooks over HTTPS, so this is only safe
+		// behind a TLS-terminating proxy.
+		slog.Warn("TLS IS DISABLED: serving plain HTTP. Only run this behind a TLS-terminating proxy, never in production.")
+	}
+
+	shutdownTracing, err := setupTracing(ctx, cfg.TracingEndpoint)
+	if err != nil {
+		fatal("Error setting up tracing", "error", err)
+	}
+
+	// Listen up front so a bad address or a port in use fails startup.
+	listener, err := listen(cfg)
+	if err != nil {
+		fatal("Error listening", "addr", server.Addr, "error", err)
+	}
+
+	go func() {
+		slog.Info("Starting webhook server", "addr", listener.Addr().String(), "tls", cfg.TLSEnabled)
+
+		var err error
+		if cfg.TLSEnabled {
+			// The certificate comes from TLSConfig.GetCertificate.
+			err = server.ServeTLS(listener, "", "")
+		} else {
+			err = server.Serve(listener)
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			fatal("Webhook server stopped", "error", err)
+		}
+	}()
+
+	if cfg.SelfRegister {
+		caBundleFile := cfg.SelfRegisterCAFile
+		if caBundleFile == "" {
+			caBundleFile = cfg.TLSCertFile
+		}
+		if err := registerWebhook(ctx, clientset, cfg, caBundleFile); err != nil {
+			fatal("Error registering webhook", "name", cfg.WebhookConfigName, "error", err)
+		}
+		slog.Info("Registered MutatingWebhookConfiguration", "name", cfg.WebhookConfigName, "caBundleFile", caBundleFile)
+	}
+
+	// A stale caBundle after a cert rotation fails every admission with an
+	// opaque TLS error on the API server side, so call it out here.
+	if cfg.CheckCABundle && cfg.TLSEnabled {
+		mismatches, err := checkCABundle(ctx, clientset, cfg.WebhookConfigName, cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			slog.Warn("Could not check the webhook caBundle", "name", cfg.WebhookConfigName, "error", err)
+		}
+		for _, mismatch := range mismatches {
+			slog.Warn("CA BUNDLE MISMATCH: the API server will not trust this webhook. Update the MutatingWebhookConfiguration's caBundle.", "name", cfg.WebhookConfigName, "problem", mismatch)
+		}
+	}
+
+	// Give in-flight admissions a chance to finish before exiting.
+	<-ctx.Done()
+	stop()
+	slog.Info("Shutting down webhook server", "timeout", cfg.ShutdownTimeout)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	// Unregister first so the API server stops calling us before we stop
+	// listening.
+	if cfg.SelfRegister && cfg.SelfRegisterCleanup {
+		if err := unregisterWebhook(shutdownCtx, clientset, cfg.WebhookConfigName); err != nil {
+			slog.Error("Error removing MutatingWebhookConfiguration", "name", cfg.WebhookConfigName, "error", err)
+		} else {
+			slog.Info("Removed MutatingWebhookConfiguration", "name", cfg.WebhookConfigName)
+		}
+	}
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Graceful shutdown failed", "error", err)
+	}
+	if err := closeLabelSource(); err != nil {
+		slog.Error("Closing label source failed", "error", err)
+	}
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Error("Flushing traces failed", "error", err)
+	}
+}
+
+// listenAddress returns the host:port the webhook server listens on.
+// JoinHostPort brackets IPv6 addresses; brackets already in BIND_ADDRESS are
+// tolerated.
+func listenAddress(cfg Config) string {
+	return net.JoinHostPort(strings.Trim(cfg.BindAddress, "[]"), cfg.Port)
+}
+
+// listen opens the webhook server's TCP listener on listenAddress(cfg).
+func listen(cfg Config) (net.Listener, error) {
+	return net.Listen("tcp", listenAddress(cfg))
+}
+
+// Webhook serves the admission endpoints and holds their dependencies.
+type Webhook struct {
+	client kubernetes.Interface
+	labels LabelSource
+	config Config
+	logger *slog.Logger
+
+	namespaces       *namespaceCache
+	namespaceMetrics *namespaceMetrics
+	// namespaceSelector is parsed from config.NamespaceSelector; nil means
+	// every namespace is selected.
+	namespaceSelector labels.Selector
+
+	// draining is set by /drain to fail readiness ahead of a shutdown.
+	draining atomic.Bool
+}
+
+// NewWebhook returns a Webhook using the given dependencies. It fails if the
+// config holds an invalid namespace selector.
+func NewWebhook(client kubernetes.Interface, labelSource LabelSource, config Config, logger *slog.Logger) (*Webhook, error) {
+	wh := &Webhook{
+		client:     client,
+		labels:     labelSource,
+		config:     config,
+		logger:     logger,
+		namespaces: newNamespaceCache(client, config.NamespaceCacheTTL),
+
+		namespaceMetrics: &namespaceMetrics{limit: config.MetricsNamespaceLimit},
+	}
+	if config.NamespaceSelector != "" {
+		selector, err := labels.Parse(config.NamespaceSelector)
+		if err != nil {
+			return nil, fmt.Errorf("parsing namespace selector %q: %w", config.NamespaceSelector, err)
+		}
+		wh.namespaceSelector = selector
+	}
+	return wh, nil
+}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8443"
+// ServeMutate handles the AdmissionReview request.
+func (wh *Webhook) ServeMutate(w http.ResponseWriter, r *http.Request) {
+	admissionRequestsTotal.Inc()
+	stats.total.Add(1)
+
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer.Start(ctx, "admission")
+	defer span.End()
+
+	_, parseSpan := tracer.Start(ctx, "parse")
+	reviewReq, ok := wh.readAdmissionReview(w, r)
+	parseSpan.End()
+	if !ok {
+		return
 	}
-	log.Printf("Starting webhook server on port %s", port)
+	span.SetAttributes(
+		attribute.String("admission.uid", string(reviewReq.Request.UID)),
+		attribute.String("admission.namespace", reviewReq.Request.Namespace),
+		attribute.String("admission.operation", string(reviewReq.Request.Operation)),
+	)
 
-	// TLS cert/key should be mounted at /tls/tls.crt and /tls/tls.key.
-	log.Fatal(http.ListenAndServeTLS(":"+port, "/tls/tls.crt", "/tls/tls.key", nil))
+	// Bound all downstream calls so the work stops once the API server has
+	// given up on us.
+	ctx, cancel := context.WithTimeout(ctx, wh.config.HandlerTimeout)
+	defer cancel()
+
+	// Call the mutation logic, which returns an AdmissionResponse.
+	mutateCtx, mutateSpan := tracer.Start(ctx, "mutate")
+	timer := prometheus.NewTimer(mutationDuration)
+	response := wh.mutate(mutateCtx, reviewReq)
+	timer.ObserveDuration()
+	mutateSpan.SetAttributes(attribute.Bool("admission.allowed", response.Allowed))
+	mutateSpan.End()
+	recordDecision(response)
+
+	wh.writeAdmissionResponse(w, reviewReq.APIVersion, reviewReq.Request.UID, response)
 }
 
-// serveMutate handles the AdmissionReview request.
-func serveMutate(w http.ResponseWriter, r *http.Request, clientset *kubernetes.Clientset) {
-	body, err := io.ReadAll(r.Body)
+// readAdmissionReview parses an AdmissionReview from the request. On failure
+// it writes an error response and returns false.
+func (wh *Webhook) readAdmissionReview(w http.ResponseWriter, r *http.Request) (*admissionv1.AdmissionReview, bool) {
+	// Only the API server's POSTs are admission requests.
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed, use POST", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+
+	v1 := admissionv1.SchemeGroupVersion.String()
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, wh.config.MaxBodyBytes))
 	defer r.Body.Close()
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		wh.writeAdmissionError(w, http.StatusRequestEntityTooLarge, v1, "", fmt.Sprintf("Request body exceeds %d bytes", maxBytesErr.Limit))
+		return nil, false
+	}
 	if err != nil || len(body) == 0 {
-		writeAdmissionError(w, http.StatusBadRequest, "Empty request body")
-		return
+		wh.writeAdmissionError(w, http.StatusBadRequest, v1, "", "Empty request body")
+		return nil, false
+	}
+
+	// Echo the request's version and UID on errors where we can recover
+	// them.
+	apiVersion, uid := peekReview(body)
+	if id, ok := r.Context().Value(reviewIDKey{}).(*reviewID); ok {
+		id.apiVersion, id.uid = apiVersion, uid
+	}
+
+	// The API server always sends JSON; anything else is a misconfigured caller.
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		wh.writeAdmissionError(w, http.StatusUnsupportedMediaType, apiVersion, uid, "Content-Type must be application/json")
+		return nil, false
 	}
 
 	var reviewReq admissionv1.AdmissionReview
 	if err := json.Unmarshal(body, &reviewReq); err != nil {
-		writeAdmissionError(w, http.StatusBadRequest, "Could not unmarshal AdmissionReview")
-		return
+		wh.logger.Warn("Could not unmarshal AdmissionReview", "uid", uid, "error", err)
+		wh.writeAdmissionError(w, http.StatusBadRequest, apiVersion, uid, "Could not unmarshal AdmissionReview")
+		return nil, false
+	}
+	// A review registered with the wrong admissionReviewVersions would
+	// otherwise be silently misread.
+	if !slices.Contains(supportedReviewVersions, reviewReq.APIVersion) || reviewReq.Kind != "AdmissionReview" {
+		wh.writeAdmissionError(w, http.StatusBadRequest, apiVersion, uid, fmt.Sprintf(
+			"Unsupported review %s %s, expected an AdmissionReview of version %s; check the webhook's admissionReviewVersions",
+			reviewReq.APIVersion, reviewReq.Kind, strings.Join(supportedReviewVersions, " or ")))
+		return nil, false
 	}
+	if reviewReq.Request == nil {
+		wh.writeAdmissionError(w, http.StatusBadRequest, apiVersion, "", "AdmissionReview.Request is nil")
+		return nil, false
+	}
+	return &reviewReq, true
+}
 
-	// Call the mutation logic, which returns an AdmissionResponse.
-	response := mutate(&reviewReq, clientset)
-	response.UID = reviewReq.Request.UID
+// peekReview extracts just the apiVersion and request.uid from an
+// AdmissionReview body, so error responses can carry them even when the full
+// review fails to decode. The apiVersion falls back to v1 when it is missing
+// or unsupported. When the body is not JSON at all or has no request, the UID
+// is unrecoverable and the error response carries an empty UID.
+func peekReview(body []byte) (string, types.UID) {
+	var partial struct {
+		APIVersion string `json:"apiVersion"`
+		Request    *struct {
+			UID types.UID `json:"uid"`
+		} `json:"request"`
+	}
+	_ = json.Unmarshal(body, &partial)
 
-	// Wrap the response in an AdmissionReview with TypeMeta.
-	reviewResp := admissionv1.AdmissionReview{
-		TypeMeta: metav1.TypeMeta{
-			APIVersion: "admission.k8s.io/v1",
-			Kind:       "AdmissionReview",
-		},
-		Response: response,
+	apiVersion := partial.APIVersion
+	if !slices.Contains(supportedReviewVersions, apiVersion) {
+		apiVersion = admissionv1.SchemeGroupVersion.String()
 	}
+	if partial.Request == nil {
+		return apiVersion, ""
+	}
+	return apiVersion, partial.Request.UID
+}
 
-	respBytes, err := json.Marshal(reviewResp)
+// writeAdmissionResponse wraps resp in an AdmissionReview of the request's
+// apiVersion, carrying the request UID, and writes it.
+func (wh *Webhook) writeAdmissionResponse(w http.ResponseWriter, apiVersion string, uid types.UID, resp *admissionv1.AdmissionResponse) {
+	respBytes, err := marshalAdmissionReview(apiVersion, uid, resp)
 	if err != nil {
-		writeAdmissionError(w, http.StatusInternalServerError, "Could not marshal AdmissionReview response")
+		wh.logger.Error("Could not marshal AdmissionReview response", "uid", uid, "error", err)
+		wh.writeAdmissionError(w, http.StatusInternalServerError, apiVersion, uid, "Could not marshal AdmissionReview response")
 		return
 	}
 
@@ -79,117 +434,732 @@ func serveMutate(w http.ResponseWriter, r *http.Request, clientset *kubernetes.C
 	w.Write(respBytes)
 }
 
-// mutate checks for the target label and builds a JSON patch.
-func mutate(ar *admissionv1.AdmissionReview, clientset *kubernetes.Clientset) *admissionv1.AdmissionResponse {
+// marshalAdmissionReview sets the UID on resp and wraps it in an
+// AdmissionReview with TypeMeta. A patch type without a patch is dropped,
+// as some API servers warn about it.
+func marshalAdmissionReview(apiVersion string, uid types.UID, resp *admissionv1.AdmissionResponse) ([]byte, error) {
+	resp.UID = uid
+	if len(resp.Patch) == 0 {
+		resp.PatchType = nil
+	}
+	return json.Marshal(admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: apiVersion,
+			Kind:       "AdmissionReview",
+		},
+		Response: resp,
+	})
+}
+
+// mutate checks for the target label and builds a JSON patch. It logs one
+// line per request recording the decision.
+//
+// mutate is idempotent, as reinvocation (reinvocationPolicy: IfNeeded)
+// requires: every op is skipped when the pod already has its effect (equal
+// label values, env vars already set, the sidecar marker present, removed
+// labels absent), and the mutated marker is only stamped alongside other
+// ops, so a pod it already mutated gets no patch at all.
+func (wh *Webhook) mutate(ctx context.Context, ar *admissionv1.AdmissionReview) (resp *admissionv1.AdmissionResponse) {
 	req := ar.Request
+	logger := wh.requestLogger(req)
+	counters := wh.countersFor(ctx, req)
+
+	// Soft issues are reported to the user as admission warnings, which
+	// kubectl prints, rather than failing the request.
+	var warnings []string
+	defer func() {
+		resp.Warnings = append(resp.Warnings, warnings...)
+		logger.InfoContext(ctx, "Admission decision", "decision", decision(resp), "message", resultMessage(resp), "warnings", resp.Warnings)
+	}()
+
+	// Dry-run requests are never persisted. The label lookup is a read-only
+	// GET, so it still runs and the patch is returned to show what would
+	// happen.
+	if isDryRun(req) {
+		logger = logger.With("dryRun", true)
+		logger.DebugContext(ctx, "Handling dry-run request")
+	}
+
+	// Only handle the pods resource itself, not its subresources, and the
+	// pod templates of the enabled workload kinds. Every patch path is
+	// relative to root.
+	root, ok := wh.podRoot(req)
+	if !ok {
+		counters.allowed.Inc()
+		logger.DebugContext(ctx, "Skipping non-pod request", "kind", req.Kind.Kind, "resource", req.Resource.Resource, "subResource", req.SubResource)
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+
+	// Only act on the configured operations.
+	if !slices.Contains(wh.config.HandleOperations, string(req.Operation)) {
+		counters.allowed.Inc()
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
 
-	// Only handle Pod objects.
-	if req.Kind.Kind != "Pod" {
+	// Leave pods in excluded namespaces untouched.
+	if slices.Contains(wh.config.ExcludedNamespaces, req.Namespace) {
+		counters.allowed.Inc()
 		return &admissionv1.AdmissionResponse{Allowed: true}
 	}
 
-	var pod corev1.Pod
-	if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
+	// DELETE requests carry no object; there is nothing to mutate.
+	if len(req.Object.Raw) == 0 {
+		counters.allowed.Inc()
+		logger.DebugContext(ctx, "Skipping request without an object")
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+
+	decoded, err := decodePod(req.Object.Raw, root, wh.config.StrictDecode)
+	if err != nil {
+		counters.errors.Inc()
 		return &admissionv1.AdmissionResponse{
 			Allowed: false,
-			Result:  &metav1.Status{Message: "Could not unmarshal Pod: " + err.Error()},
+			Result:  &metav1.Status{Message: "Could not unmarshal " + req.Kind.Kind + ": " + err.Error()},
 		}
 	}
+	pod := *decoded
+	// Pods created by controllers are usually unnamed at admission time, so
+	// identify them by generateName and owner.
+	name, owner := podName(&pod), podOwner(&pod)
+	logger = logger.With("pod", name, "owner", owner)
 
-	// Check for a label key starting with "rollouts-pod-template-hash".
+	// Honor the pod's opt-out annotation.
+	if skip, _ := strconv.ParseBool(pod.Annotations[wh.config.SkipAnnotation]); skip {
+		counters.allowed.Inc()
+		logger = logger.With("skipAnnotation", wh.config.SkipAnnotation)
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+
+	// Check for a label key matching any of the targets.
 	found := false
 	for key := range pod.Labels {
-		if strings.HasPrefix(key, "rollouts-pod-template-hash") {
+		if wh.isTargetKey(key) {
 			found = true
 			break
 		}
 	}
 
 	if !found {
+		counters.allowed.Inc()
 		return &admissionv1.AdmissionResponse{Allowed: true}
 	}
 
-	// Retrieve labels from the external API (MOCK)
-	labels, err := getLabelsFromAPI()
+	// Only mutate in namespaces matching the namespace selector, if any.
+	// This comes after the target check so that only targeted pods depend
+	// on the namespace lookup succeeding.
+	selected, err := wh.namespaceSelected(ctx, req.Namespace)
 	if err != nil {
+		counters.errors.Inc()
+		if wh.config.FailOpen {
+			logger.ErrorContext(ctx, "Error looking up namespace, failing open", "error", err)
+			warnings = append(warnings, "namespace lookup failed, pod admitted without labels")
+			return &admissionv1.AdmissionResponse{Allowed: true}
+		}
 		return &admissionv1.AdmissionResponse{
 			Allowed: false,
-			Result:  &metav1.Status{Message: "Error retrieving labels from API: " + err.Error()},
+			Result:  &metav1.Status{Message: "Error looking up namespace: " + err.Error()},
 		}
 	}
+	if !selected {
+		counters.allowed.Inc()
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
 
-	// Build the JSON patch.
-	var patches []map[string]interface{}
-	if pod.Labels == nil {
-		patches = append(patches, map[string]interface{}{
-			"op":    "add",
-			"path":  "/metadata/labels",
-			"value": map[string]string{},
-		})
+	// Test mode: deny every matching pod. The denial counts as an error
+	// so FORCE_DENY shows up on the same dashboards as real failures.
+	if wh.config.ForceDeny {
+		counters.errors.Inc()
+		return &admissionv1.AdmissionResponse{
+			Allowed: false,
+			Result:  &metav1.Status{Message: wh.config.ForceDenyMessage},
+		}
+	}
+
+	// Retrieve labels from the label source.
+	// Never ask the label source for an empty namespace.
+	namespace := req.Namespace
+	if namespace == "" {
+		namespace = pod.Namespace
+	}
+	if namespace == "" {
+		namespace = wh.config.DefaultNamespace
+	}
+	fetchCtx, fetchSpan := tracer.Start(ctx, "fetch-labels")
+	labels, err := wh.labels.Fetch(fetchCtx, namespace)
+	if err != nil {
+		fetchSpan.RecordError(err)
+		fetchSpan.SetStatus(codes.Error, "label fetch failed")
+	}
+	fetchSpan.End()
+	if err != nil {
+		counters.errors.Inc()
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("handler timeout of %s exceeded: %w", wh.config.HandlerTimeout, err)
+		}
+		if wh.config.FailOpen {
+			logger.ErrorContext(ctx, "Error retrieving labels from API, failing open", "error", err)
+			warnings = append(warnings, "label source unavailable, pod admitted without labels")
+			return &admissionv1.AdmissionResponse{Allowed: true}
+		}
+		return &admissionv1.AdmissionResponse{
+			Allowed: false,
+			Result: &metav1.Status{
+				Message: "Error retrieving labels from API: " + err.Error(),
+				Reason:  reasonLabelFetchFailed,
+				Code:    http.StatusServiceUnavailable,
+			},
+		}
 	}
 
+	if len(labels) == 0 {
+		warnings = append(warnings, "label source returned no labels")
+	}
+
+	// Keep only allowlisted keys from the label source, if configured.
+	if len(wh.config.AllowedLabelKeys) > 0 {
+		allowed := make(map[string]string, len(labels))
+		for key, value := range labels {
+			if slices.Contains(wh.config.AllowedLabelKeys, key) {
+				allowed[key] = value
+			}
+		}
+		labels = allowed
+	}
+
+	// Copy the configured labels from the pod's controllers. A missing or
+	// unreadable owner only costs those labels.
+	var fromOwners map[string]string
+	if len(wh.config.OwnerLabelKeys) > 0 {
+		fromOwners, err = wh.ownerLabels(ctx, req.Namespace, metav1.GetControllerOf(&pod))
+		if err != nil {
+			logger.WarnContext(ctx, "Error reading pod owner labels", "error", err)
+			warnings = append(warnings, "could not read labels from pod owner: "+err.Error())
+		}
+	}
+
+	// Copy the configured annotations of the pod's namespace. An unreadable
+	// namespace only costs those labels.
+	var fromNamespace map[string]string
+	if len(wh.config.NamespaceAnnotationLabels) > 0 {
+		fromNamespace, err = wh.namespaceAnnotationLabels(ctx, namespace)
+		if err != nil {
+			logger.WarnContext(ctx, "Error reading namespace annotations", "error", err)
+			warnings = append(warnings, "could not read namespace annotations: "+err.Error())
+		}
+	}
+
+	// Render the templated labels from the pod's fields.
+	var fromTemplates map[string]string
+	if len(wh.config.LabelTemplates) > 0 {
+		var errs []error
+		fromTemplates, errs = renderLabelTemplates(wh.config.LabelTemplates, req.Namespace, &pod)
+		for _, err := range errs {
+			logger.WarnContext(ctx, "Error rendering label template", "error", err)
+			warnings = append(warnings, "skipped templated label: "+err.Error())
+		}
+	}
+
+	// Merge in the static, templated, namespace-derived and owner-derived
+	// labels, each taking precedence over the ones before; fetched values
+	// win over all of them.
+	if len(wh.config.StaticLabels) > 0 || len(fromTemplates) > 0 || len(fromNamespace) > 0 || len(fromOwners) > 0 {
+		merged := maps.Clone(wh.config.StaticLabels)
+		if merged == nil {
+			merged = make(map[string]string)
+		}
+		maps.Copy(merged, fromTemplates)
+		maps.Copy(merged, fromNamespace)
+		maps.Copy(merged, fromOwners)
+		maps.Copy(merged, labels)
+		labels = merged
+	}
+
+	// Label values are capped at 63 characters; apply the configured policy
+	// before validation would reject them outright.
+	if wh.config.InjectAs == injectAsLabels {
+		fitted := make(map[string]string, len(labels))
+		for key, value := range labels {
+			if len(value) <= validation.LabelValueMaxLength {
+				fitted[key] = value
+				continue
+			}
+			switch wh.config.LongValuePolicy {
+			case longValuePolicyDeny:
+				counters.errors.Inc()
+				return &admissionv1.AdmissionResponse{
+					Allowed: false,
+					Result: &metav1.Status{
+						Message: fmt.Sprintf("Label source returned a value for %q longer than %d characters", key, validation.LabelValueMaxLength),
+						Reason:  reasonInvalidLabel,
+						Code:    http.StatusUnprocessableEntity,
+					},
+				}
+			case longValuePolicyTruncate:
+				truncated := truncateLabelValue(value)
+				warnings = append(warnings, fmt.Sprintf("label %q value truncated to %q", key, truncated))
+				fitted[key] = truncated
+			default:
+				warnings = append(warnings, fmt.Sprintf("label %q skipped: value longer than %d characters", key, validation.LabelValueMaxLength))
+			}
+		}
+		labels = fitted
+	}
+
+	// Drop, or deny on, entries the API server would reject.
+	valid := make(map[string]string, len(labels))
 	for key, value := range labels {
+		if reason := invalidEntryReason(key, value, wh.config.InjectAs); reason != "" {
+			if wh.config.InvalidLabelPolicy == invalidLabelPolicyDeny {
+				counters.errors.Inc()
+				return &admissionv1.AdmissionResponse{
+					Allowed: false,
+					Result: &metav1.Status{
+						Message: "Label source returned an invalid entry: " + reason,
+						Reason:  reasonInvalidLabel,
+						Code:    http.StatusUnprocessableEntity,
+					},
+				}
+			}
+			logger.WarnContext(ctx, "Skipping invalid label", "reason", reason)
+			warnings = append(warnings, "skipped invalid label "+reason)
+			continue
+		}
+		valid[key] = value
+	}
+	labels = valid
+
+	// Keys differing only by case would produce conflicting patch ops.
+	labels, dropped := dedupeKeysFold(labels)
+	for _, key := range dropped {
+		logger.WarnContext(ctx, "Skipping label whose key differs from another only by case", "key", key)
+		warnings = append(warnings, fmt.Sprintf("skipped label %q: key differs from another only by case", key))
+	}
+
+	// Fetched key/values go into the pod's labels or, if configured, its
+	// annotations.
+	basePath, current := root+"/metadata/labels", pod.Labels
+	if wh.config.InjectAs == injectAsAnnotations {
+		basePath, current = root+"/metadata/annotations", pod.Annotations
+	}
+
+	// Don't re-add keys a user removed: they (or their GitOps tooling) took
+	// them off on purpose, and putting them back would have the two fight
+	// forever. Removals seen on UPDATE are recorded in the removed-labels
+	// annotation, so later updates honour them too.
+	optedOut := make(map[string]bool)
+	for _, key := range splitList(pod.Annotations[removedLabelsAnnotation]) {
+		optedOut[key] = true
+	}
+	recordRemoved := false
+	if req.Operation == admissionv1.Update && len(req.OldObject.Raw) > 0 {
+		oldPod, err := decodePod(req.OldObject.Raw, root, false)
+		if err != nil {
+			logger.WarnContext(ctx, "Could not unmarshal old Pod, not checking for removed labels", "error", err)
+		} else {
+			// An update replacing the annotations wholesale must not drop
+			// earlier removals.
+			for _, key := range splitList(oldPod.Annotations[removedLabelsAnnotation]) {
+				if !optedOut[key] {
+					optedOut[key] = true
+					recordRemoved = true
+				}
+			}
+			previous := oldPod.Labels
+			if wh.config.InjectAs == injectAsAnnotations {
+				previous = oldPod.Annotations
+			}
+			for key := range labels {
+				_, had := previous[key]
+				_, has := current[key]
+				if had && !has && !optedOut[key] {
+					logger.DebugContext(ctx, "Recording key removed by the update", "key", key)
+					optedOut[key] = true
+					recordRemoved = true
+				}
+			}
+		}
+	}
+	for key := range optedOut {
+		delete(labels, key)
+	}
+
+	// Build the JSON patch, in key order so the output is stable.
+	var patches []map[string]interface{}
+	added, replaced := 0, 0
+	applied := make(map[string]string)
+	for _, key := range sortedKeys(labels) {
+		value := labels[key]
 		op := "add"
-		if pod.Labels != nil {
-			if _, exists := pod.Labels[key]; exists {
-				op = "replace"
+		if existing, exists := current[key]; exists {
+			// Skip labels the pod already carries with the same value.
+			if existing == value {
+				continue
 			}
+			op = "replace"
 		}
+		if op == "add" {
+			added++
+		} else {
+			replaced++
+		}
+		applied[key] = value
 		patches = append(patches, map[string]interface{}{
 			"op":    op,
-			"path":  "/metadata/labels/" + escapeJSONPointer(key),
+			"path":  mapKeyPath(basePath, key),
 			"value": value,
 		})
 	}
+	// Create a missing map only when there is something to put in it, so an
+	// empty label set yields no patch at all.
+	if current == nil && len(patches) > 0 {
+		patches = append([]map[string]interface{}{{
+			"op":    "add",
+			"path":  basePath,
+			"value": map[string]string{},
+		}}, patches...)
+	}
+
+	// Strip the configured stale labels the pod carries, unless they were
+	// just set above.
+	removed := 0
+	for _, key := range wh.config.RemoveLabels {
+		if _, exists := pod.Labels[key]; !exists {
+			continue
+		}
+		if _, injected := labels[key]; injected && wh.config.InjectAs == injectAsLabels {
+			continue
+		}
+		removed++
+		patches = append(patches, map[string]interface{}{
+			"op":   "remove",
+			"path": mapKeyPath(root+"/metadata/labels", key),
+		})
+	}
+
+	// Inject the configured env var into every container, and init
+	// container if enabled.
+	env := corev1.EnvVar{Name: wh.config.InjectEnvName, Value: wh.config.InjectEnvValue}
+	if wh.config.InjectEnvName != "" {
+		patches = append(patches, containerEnvPatches(pod.Spec.Containers, root+"/spec/containers", env)...)
+		if wh.config.IncludeInitContainers {
+			patches = append(patches, containerEnvPatches(pod.Spec.InitContainers, root+"/spec/initContainers", env)...)
+		}
+	}
+
+	// The annotations map must exist before annotations are added to it. In
+	// annotations mode it was created above if anything was added to it.
+	hasAnnotations := pod.Annotations != nil || (wh.config.InjectAs == injectAsAnnotations && len(applied) > 0)
+	ensureAnnotations := func() {
+		if !hasAnnotations {
+			patches = append(patches, map[string]interface{}{
+				"op":    "add",
+				"path":  root + "/metadata/annotations",
+				"value": map[string]string{},
+			})
+			hasAnnotations = true
+		}
+	}
+
+	// Inject the sidecar once, marking the pod in the same patch. It gets
+	// the env var up front, as a reinvocation would otherwise add it.
+	if wh.config.Sidecar != nil && needsSidecar(&pod, wh.config.Sidecar) {
+		sidecar := wh.config.Sidecar
+		if wh.config.InjectEnvName != "" {
+			sidecar = withEnvVar(sidecar, env)
+		}
+		ensureAnnotations()
+		patches = append(patches, map[string]interface{}{
+			"op":    "add",
+			"path":  root + "/spec/containers/-",
+			"value": sidecar,
+		}, map[string]interface{}{
+			"op":    "add",
+			"path":  mapKeyPath(root+"/metadata/annotations", sidecarInjectedAnnotation),
+			"value": "true",
+		})
+	}
+
+	// Record the removed keys, so they stay off on later updates.
+	if recordRemoved {
+		ensureAnnotations()
+		patches = append(patches, map[string]interface{}{
+			"op":    "add",
+			"path":  mapKeyPath(root+"/metadata/annotations", removedLabelsAnnotation),
+			"value": strings.Join(sortedKeys(optedOut), ","),
+		})
+	}
+
+	// A pod that needs no changes, including one already processed on an
+	// earlier admission, is left alone without re-stamping the marker.
+	if len(patches) == 0 {
+		counters.allowed.Inc()
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+
+	// Stamp the pod as processed; "add" replaces an existing marker.
+	ensureAnnotations()
+	patches = append(patches, map[string]interface{}{
+		"op":    "add",
+		"path":  mapKeyPath(root+"/metadata/annotations", mutatedAnnotation),
+		"value": time.Now().UTC().Format(time.RFC3339),
+	})
 
 	patchBytes, err := json.Marshal(patches)
 	if err != nil {
+		counters.errors.Inc()
 		return &admissionv1.AdmissionResponse{
 			Allowed: false,
 			Result:  &metav1.Status{Message: "Could not marshal JSON patch: " + err.Error()},
 		}
 	}
 
+	// Fail with a clear message rather than have the API server reject an
+	// oversized patch opaquely.
+	if wh.config.MaxPatchBytes > 0 && len(patchBytes) > wh.config.MaxPatchBytes {
+		counters.errors.Inc()
+		logger.ErrorContext(ctx, "Patch exceeds MAX_PATCH_BYTES", "patchBytes", len(patchBytes), "maxPatchBytes", wh.config.MaxPatchBytes, "ops", len(patches))
+		return &admissionv1.AdmissionResponse{
+			Allowed: false,
+			Result: &metav1.Status{Message: fmt.Sprintf(
+				"Generated patch is %d bytes, over the %d byte limit; reduce the labels returned for this namespace", len(patchBytes), wh.config.MaxPatchBytes)},
+		}
+	}
+
+	// The patch may carry label values, so it is only logged when
+	// debugging; the check skips the copy otherwise.
+	if logger.Enabled(ctx, slog.LevelDebug) {
+		logger.DebugContext(ctx, "Generated patch", "patch", string(patchBytes))
+	}
+
+	if wh.config.PatchSelfCheck {
+		if err := checkPatch(req.Object.Raw, patchBytes, root, wh.config.InjectAs, applied); err != nil {
+			logger.ErrorContext(ctx, "Generated patch failed self-check", "error", err, "patch", string(patchBytes))
+		}
+	}
+
+	counters.mutated.Inc()
+	logger = logger.With("labelsAdded", added, "labelsReplaced", replaced, "labelsRemoved", removed)
+	// Events are a side effect, so dry runs skip them. So do pods only
+	// named by generateName: the API server picks the name after admission,
+	// and an event naming the prefix would point at no object.
+	if wh.config.EmitEvents && len(applied) > 0 && !isDryRun(req) {
+		if pod.Name == "" {
+			logger.DebugContext(ctx, "Not emitting an event for a pod without a name yet")
+		} else {
+			wh.emitMutationEvent(req.Kind, req.Namespace, pod.Name, applied)
+		}
+	}
 	patchType := admissionv1.PatchTypeJSONPatch
 	return &admissionv1.AdmissionResponse{
 		Allowed:   true,
 		Patch:     patchBytes,
 		PatchType: &patchType,
+		// The API server prefixes these keys with the webhook name.
+		AuditAnnotations: map[string]string{
+			"pod":             name,
+			"owner":           owner,
+			"labels-added":    strconv.Itoa(added),
+			"labels-replaced": strconv.Itoa(replaced),
+			"labels-removed":  strconv.Itoa(removed),
+		},
+	}
+}
+
+// serveHealthz reports that the server is up, for use as a liveness probe.
+func serveHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("ok"))
+}
+
+// ServeReadyz reports whether the API server is reachable and the webhook is
+// not draining, for use as a readiness probe.
+func (wh *Webhook) ServeReadyz(w http.ResponseWriter, r *http.Request) {
+	if wh.draining.Load() {
+		writeJSONError(w, http.StatusServiceUnavailable, "Draining")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), readyzTimeout)
+	defer cancel()
+
+	// Equivalent to Discovery().ServerVersion(), but bounded by ctx.
+	if err := wh.client.Discovery().RESTClient().Get().AbsPath("/version").Do(ctx).Error(); err != nil {
+		wh.logger.Warn("Readiness check failed", "error", err)
+		writeJSONError(w, http.StatusServiceUnavailable, "API server unreachable")
+		return
 	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("ok"))
 }
 
 // writeAdmissionError returns a valid AdmissionReview with an error status.
-func writeAdmissionError(w http.ResponseWriter, code int, message string) {
-	w.WriteHeader(code)
+func (wh *Webhook) writeAdmissionError(w http.ResponseWriter, code int, apiVersion string, uid types.UID, message string) {
+	// The review could not be read, so its namespace and operation are
+	// unknown.
+	admissionErrorsTotal.WithLabelValues("", "").Inc()
+	stats.errors.Add(1)
+	wh.logger.Warn("Rejecting admission request", "uid", uid, "code", code, "message", message)
 
-	errResp := admissionv1.AdmissionResponse{
+	respBytes, _ := marshalAdmissionReview(apiVersion, uid, &admissionv1.AdmissionResponse{
 		Allowed: false,
 		Result: &metav1.Status{
 			Message: message,
 		},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(respBytes)
+}
+
+// writeJSONError writes {"error": message} with the given status. It is used
+// by the endpoints that do not speak AdmissionReview.
+func writeJSONError(w http.ResponseWriter, code int, message string) {
+	body, _ := json.Marshal(map[string]string{"error": message})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	w.Write(body)
+}
+
+// writeNegotiated writes a JSON body with contentType, or converted to YAML
+// when the client asks for it with an Accept header, for debugging with curl.
+func writeNegotiated(w http.ResponseWriter, r *http.Request, contentType string, body []byte) {
+	if acceptsYAML(r) {
+		if yamlBody, err := yaml.JSONToYAML(body); err == nil {
+			body, contentType = yamlBody, "application/yaml"
+		}
 	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(body)
+}
 
-	reviewResp := admissionv1.AdmissionReview{
-		TypeMeta: metav1.TypeMeta{
-			APIVersion: "admission.k8s.io/v1",
-			Kind:       "AdmissionReview",
-		},
-		Response: &errResp,
+// acceptsYAML reports whether the request's Accept header lists a YAML media
+// type.
+func acceptsYAML(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, item := range strings.Split(accept, ",") {
+			mediaType, _, err := mime.ParseMediaType(item)
+			if err != nil {
+				continue
+			}
+			switch mediaType {
+			case "application/yaml", "application/x-yaml", "text/yaml":
+				return true
+			}
+		}
 	}
+	return false
+}
 
-	respBytes, _ := json.Marshal(reviewResp)
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(respBytes)
+// mapKeyPath returns the JSON patch path of key within the map at basePath,
+// such as "/metadata/labels" or "/metadata/annotations". Label and
+// annotation keys commonly contain "/" (e.g.
+// "kubectl.kubernetes.io/last-applied-configuration"), so every such path
+// must be built here rather than by concatenation.
+func mapKeyPath(basePath, key string) string {
+	return basePath + "/" + escapeJSONPointer(key)
 }
 
-// escapeJSONPointer escapes characters for a JSON patch path.
+// escapeJSONPointer escapes characters for a JSON patch path per RFC 6901.
+// "~" must be escaped before "/" so the "~1" produced for "/" is not itself
+// re-escaped; e.g. "weird~/key" becomes "weird~0~1key".
 func escapeJSONPointer(s string) string {
 	s = strings.ReplaceAll(s, "~", "~0")
 	s = strings.ReplaceAll(s, "/", "~1")
 	return s
 }
 
-// getLabelsFromAPI mocks an API call and returns labels.
-func getLabelsFromAPI() (map[string]string, error) {
-	return map[string]string{"team": "microservices"}, nil
+// invalidEntryReason explains why key=value cannot be injected, or returns ""
+// when it is valid. Annotation values are unrestricted, so only label values
+// are checked.
+func invalidEntryReason(key, value, injectAs string) string {
+	if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+		return fmt.Sprintf("key %q: %s", key, strings.Join(errs, "; "))
+	}
+	if injectAs == injectAsLabels {
+		if errs := validation.IsValidLabelValue(value); len(errs) > 0 {
+			return fmt.Sprintf("value %q for key %q: %s", value, key, strings.Join(errs, "; "))
+		}
+	}
+	return ""
+}
+
+// truncateLabelValue shortens value to the label value limit. Label values
+// must end with an alphanumeric character, so trailing separators left by
+// the cut are trimmed too.
+func truncateLabelValue(value string) string {
+	value = value[:validation.LabelValueMaxLength]
+	return strings.TrimRight(value, "-_.")
+}
+
+// sortedKeys returns the keys of m in sorted order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// dedupeKeysFold drops keys that equal another key case-insensitively,
+// keeping the one that sorts first so the winner is deterministic. It returns
+// the surviving map and the dropped keys.
+func dedupeKeysFold(labels map[string]string) (map[string]string, []string) {
+	keys := sortedKeys(labels)
+
+	kept := make(map[string]string, len(labels))
+	seen := make(map[string]bool, len(labels))
+	var dropped []string
+	for _, key := range keys {
+		folded := strings.ToLower(key)
+		if seen[folded] {
+			dropped = append(dropped, key)
+			continue
+		}
+		seen[folded] = true
+		kept[key] = labels[key]
+	}
+	return kept, dropped
+}
+
+// isDryRun reports whether the admission request is a dry run, in which case
+// the webhook must avoid side effects.
+func isDryRun(req *admissionv1.AdmissionRequest) bool {
+	return req.DryRun != nil && *req.DryRun
+}
+
+// isPodRequest reports whether req admits a core/v1 pod through the pods
+// resource itself. Subresources such as pods/ephemeralcontainers or
+// pods/status also carry a Pod object, but they only update part of the pod
+// and are not where its labels are set, so they are skipped, as is anything
+// whose kind is not Pod, whatever resource it came through.
+func isPodRequest(req *admissionv1.AdmissionRequest) bool {
+	return req.Kind.Group == "" && req.Kind.Kind == "Pod" &&
+		req.Resource.Group == "" && req.Resource.Resource == "pods" &&
+		req.SubResource == ""
+}
+
+// isTargetKey reports whether a pod label key selects the pod for mutation
+// under the configured TARGET_LABEL_MATCH mode.
+func (wh *Webhook) isTargetKey(key string) bool {
+	switch wh.config.TargetLabelMatch {
+	case targetLabelMatchExact:
+		return slices.Contains(wh.config.TargetLabelPrefixes, key)
+	case targetLabelMatchRegex:
+		return wh.config.TargetLabelPattern.MatchString(key)
+	}
+	return hasAnyPrefix(key, wh.config.TargetLabelPrefixes)
+}
+
+// hasAnyPrefix reports whether s starts with any of the given prefixes.
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
 }
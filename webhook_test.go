@@ -0,0 +1,1679 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// targetLabel is a pod label matching the default target label prefix.
+const targetLabel = defaultTargetLabelPrefix
+
+// fakeLabelSource returns fixed labels, or err, and records the namespaces
+// it is asked for.
+type fakeLabelSource struct {
+	labels map[string]string
+	err    error
+
+	mu         sync.Mutex
+	calls      int
+	namespaces []string
+}
+
+func (s *fakeLabelSource) Fetch(_ context.Context, namespace string) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	s.namespaces = append(s.namespaces, namespace)
+	if s.err != nil {
+		return nil, s.err
+	}
+	labels := make(map[string]string, len(s.labels))
+	for key, value := range s.labels {
+		labels[key] = value
+	}
+	return labels, nil
+}
+
+// testConfig returns the configuration loaded from an empty environment.
+func testConfig(t *testing.T) Config {
+	t.Helper()
+	fileSettings = nil
+	return loadConfig()
+}
+
+// newTestWebhook returns a Webhook over a fake clientset holding objects,
+// serving labels from source.
+func newTestWebhook(t *testing.T, cfg Config, source LabelSource, objects ...runtime.Object) *Webhook {
+	t.Helper()
+	wh, err := NewWebhook(fake.NewSimpleClientset(objects...), source, cfg, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("NewWebhook: %v", err)
+	}
+	return wh
+}
+
+// testPod returns a pod in namespace "apps" with the given labels.
+func testPod(labels map[string]string) *corev1.Pod {
+	return &corev1.Pod{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "apps", Labels: labels},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "app"}}},
+	}
+}
+
+// podReview wraps pod in a v1 AdmissionReview for operation.
+func podReview(t *testing.T, pod *corev1.Pod, operation admissionv1.Operation) *admissionv1.AdmissionReview {
+	t.Helper()
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatalf("marshalling pod: %v", err)
+	}
+	return &admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: admissionv1.SchemeGroupVersion.String(), Kind: "AdmissionReview"},
+		Request: &admissionv1.AdmissionRequest{
+			UID:       "test-uid",
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+			Name:      pod.Name,
+			Namespace: pod.Namespace,
+			Operation: operation,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	}
+}
+
+// patchOp is a decoded JSON patch operation.
+type patchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// markerPath is the patch path of the mutated marker annotation.
+var markerPath = mapKeyPath("/metadata/annotations", mutatedAnnotation)
+
+// decodePatch decodes the patch of resp. The mutated marker's timestamp is
+// blanked so patches compare equal across runs.
+func decodePatch(t *testing.T, resp *admissionv1.AdmissionResponse) []patchOp {
+	t.Helper()
+	if len(resp.Patch) == 0 {
+		return nil
+	}
+	var ops []patchOp
+	if err := json.Unmarshal(resp.Patch, &ops); err != nil {
+		t.Fatalf("decoding patch %s: %v", resp.Patch, err)
+	}
+	for i := range ops {
+		if ops[i].Path == markerPath {
+			ops[i].Value = ""
+		}
+	}
+	return ops
+}
+
+func TestMutate(t *testing.T) {
+	configMap := &corev1.ConfigMap{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"},
+		ObjectMeta: metav1.ObjectMeta{Name: "settings", Namespace: "apps", Labels: map[string]string{targetLabel: "abc"}},
+	}
+	configMapRaw, err := json.Marshal(configMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configMapReview := &admissionv1.AdmissionReview{
+		Request: &admissionv1.AdmissionRequest{
+			UID:       "test-uid",
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "ConfigMap"},
+			Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "configmaps"},
+			Namespace: "apps",
+			Operation: admissionv1.Create,
+			Object:    runtime.RawExtension{Raw: configMapRaw},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		review *admissionv1.AdmissionReview
+		want   []patchOp
+	}{
+		{
+			name:   "non-pod kind",
+			review: configMapReview,
+		},
+		{
+			name:   "pod without the target label",
+			review: podReview(t, testPod(map[string]string{"app": "web"}), admissionv1.Create),
+		},
+		{
+			name:   "pod with nil labels",
+			review: podReview(t, testPod(nil), admissionv1.Create),
+		},
+		{
+			name:   "pod with the target label",
+			review: podReview(t, testPod(map[string]string{targetLabel: "abc"}), admissionv1.Create),
+			want: []patchOp{
+				{Op: "add", Path: "/metadata/labels/team", Value: "microservices"},
+				{Op: "add", Path: "/metadata/annotations", Value: map[string]interface{}{}},
+				{Op: "add", Path: markerPath, Value: ""},
+			},
+		},
+		{
+			name:   "pod with the target label and an existing team label",
+			review: podReview(t, testPod(map[string]string{targetLabel: "abc", "team": "old"}), admissionv1.Create),
+			want: []patchOp{
+				{Op: "replace", Path: "/metadata/labels/team", Value: "microservices"},
+				{Op: "add", Path: "/metadata/annotations", Value: map[string]interface{}{}},
+				{Op: "add", Path: markerPath, Value: ""},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := &fakeLabelSource{labels: map[string]string{"team": "microservices"}}
+			wh := newTestWebhook(t, testConfig(t), source)
+
+			resp := wh.mutate(context.Background(), tt.review)
+
+			if !resp.Allowed {
+				t.Fatalf("mutate denied the request: %s", resultMessage(resp))
+			}
+			if got := decodePatch(t, resp); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("patch = %+v, want %+v", got, tt.want)
+			}
+			if tt.want == nil && resp.PatchType != nil {
+				t.Errorf("PatchType = %v, want nil without a patch", *resp.PatchType)
+			}
+			if tt.want != nil && (resp.PatchType == nil || *resp.PatchType != admissionv1.PatchTypeJSONPatch) {
+				t.Errorf("PatchType = %v, want JSONPatch", resp.PatchType)
+			}
+		})
+	}
+}
+
+// postReview POSTs body to url as JSON and decodes the AdmissionReview in
+// the response.
+func postReview(t *testing.T, url string, body []byte) (*http.Response, *admissionv1.AdmissionReview) {
+	t.Helper()
+	resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("POST %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	var review admissionv1.AdmissionReview
+	if err := json.NewDecoder(resp.Body).Decode(&review); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	return resp, &review
+}
+
+func TestServeMutateAppliesPatch(t *testing.T) {
+	source := &fakeLabelSource{labels: map[string]string{"team": "payments", "example.com/tier": "backend"}}
+	wh := newTestWebhook(t, testConfig(t), source)
+	server := httptest.NewServer(wh.recoverAdmission(wh.ServeMutate))
+	defer server.Close()
+
+	review := podReview(t, testPod(map[string]string{targetLabel: "abc", "team": "old"}), admissionv1.Create)
+	body, err := json.Marshal(review)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, got := postReview(t, server.URL, body)
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if got.Kind != "AdmissionReview" || got.APIVersion != admissionv1.SchemeGroupVersion.String() {
+		t.Errorf("response is %s %s, want an admission.k8s.io/v1 AdmissionReview", got.APIVersion, got.Kind)
+	}
+	if got.Response == nil || !got.Response.Allowed {
+		t.Fatalf("response = %+v, want allowed", got.Response)
+	}
+	if got.Response.UID != review.Request.UID {
+		t.Errorf("UID = %q, want %q", got.Response.UID, review.Request.UID)
+	}
+
+	patch, err := jsonpatch.DecodePatch(got.Response.Patch)
+	if err != nil {
+		t.Fatalf("decoding patch %s: %v", got.Response.Patch, err)
+	}
+	patched, err := patch.Apply(review.Request.Object.Raw)
+	if err != nil {
+		t.Fatalf("applying patch %s: %v", got.Response.Patch, err)
+	}
+	var pod corev1.Pod
+	if err := json.Unmarshal(patched, &pod); err != nil {
+		t.Fatalf("decoding patched pod: %v", err)
+	}
+	wantLabels := map[string]string{targetLabel: "abc", "team": "payments", "example.com/tier": "backend"}
+	if !reflect.DeepEqual(pod.Labels, wantLabels) {
+		t.Errorf("patched labels = %v, want %v", pod.Labels, wantLabels)
+	}
+	if _, ok := pod.Annotations[mutatedAnnotation]; !ok {
+		t.Errorf("patched pod lacks the %s annotation", mutatedAnnotation)
+	}
+}
+
+func TestEscapeJSONPointer(t *testing.T) {
+	tests := []struct {
+		key, want string
+	}{
+		{"team", "team"},
+		{"example.com/team", "example.com~1team"},
+		{"weird~/key", "weird~0~1key"},
+		{"~1", "~01"},
+		{"a/~b", "a~1~0b"},
+	}
+	for _, tt := range tests {
+		if got := escapeJSONPointer(tt.key); got != tt.want {
+			t.Errorf("escapeJSONPointer(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+		if got, want := mapKeyPath("/metadata/labels", tt.key), "/metadata/labels/"+tt.want; got != want {
+			t.Errorf("mapKeyPath(%q) = %q, want %q", tt.key, got, want)
+		}
+	}
+
+	key := "kubectl.kubernetes.io/last-applied-configuration"
+	if got, want := mapKeyPath("/metadata/annotations", key), "/metadata/annotations/kubectl.kubernetes.io~1last-applied-configuration"; got != want {
+		t.Errorf("mapKeyPath(%q) = %q, want %q", key, got, want)
+	}
+}
+
+func TestMutateUpdateKeepsRemovedLabelsOff(t *testing.T) {
+	removedPath := mapKeyPath("/metadata/annotations", removedLabelsAnnotation)
+	withAnnotation := func(pod *corev1.Pod) *corev1.Pod {
+		pod.Annotations = map[string]string{removedLabelsAnnotation: "team"}
+		return pod
+	}
+	updateReview := func(oldPod, newPod *corev1.Pod) *admissionv1.AdmissionReview {
+		review := podReview(t, newPod, admissionv1.Update)
+		raw, err := json.Marshal(oldPod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		review.Request.OldObject = runtime.RawExtension{Raw: raw}
+		return review
+	}
+
+	tests := []struct {
+		name   string
+		review *admissionv1.AdmissionReview
+		want   []patchOp
+	}{
+		{
+			name: "update removing the label",
+			review: updateReview(
+				testPod(map[string]string{targetLabel: "abc", "team": "payments"}),
+				testPod(map[string]string{targetLabel: "abc"})),
+			want: []patchOp{
+				{Op: "add", Path: "/metadata/annotations", Value: map[string]interface{}{}},
+				{Op: "add", Path: removedPath, Value: "team"},
+				{Op: "add", Path: markerPath, Value: ""},
+			},
+		},
+		{
+			name: "later update",
+			review: updateReview(
+				withAnnotation(testPod(map[string]string{targetLabel: "abc"})),
+				withAnnotation(testPod(map[string]string{targetLabel: "abc", "app": "web"}))),
+		},
+		{
+			name: "later update replacing the annotations",
+			review: updateReview(
+				withAnnotation(testPod(map[string]string{targetLabel: "abc"})),
+				testPod(map[string]string{targetLabel: "abc"})),
+			want: []patchOp{
+				{Op: "add", Path: "/metadata/annotations", Value: map[string]interface{}{}},
+				{Op: "add", Path: removedPath, Value: "team"},
+				{Op: "add", Path: markerPath, Value: ""},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.HandleOperations = []string{string(admissionv1.Create), string(admissionv1.Update)}
+			wh := newTestWebhook(t, cfg, &fakeLabelSource{labels: map[string]string{"team": "payments"}})
+
+			resp := wh.mutate(context.Background(), tt.review)
+
+			if !resp.Allowed {
+				t.Fatalf("mutate denied the request: %s", resultMessage(resp))
+			}
+			if got := decodePatch(t, resp); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("patch = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// serveReview runs body through /mutate's handler and decodes the
+// AdmissionReview it answers with.
+func serveReview(t *testing.T, wh *Webhook, body []byte) (int, *admissionv1.AdmissionReview) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	wh.recoverAdmission(wh.ServeMutate)(w, r)
+
+	var review admissionv1.AdmissionReview
+	if err := json.Unmarshal(w.Body.Bytes(), &review); err != nil {
+		t.Fatalf("decoding response %q: %v", w.Body, err)
+	}
+	return w.Code, &review
+}
+
+func TestServeMutateNilRequest(t *testing.T) {
+	wh := newTestWebhook(t, testConfig(t), &fakeLabelSource{})
+
+	code, review := serveReview(t, wh, []byte(`{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview","request":null}`))
+
+	if code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", code, http.StatusBadRequest)
+	}
+	if review.Response == nil || review.Response.Allowed {
+		t.Fatalf("response = %+v, want a denial", review.Response)
+	}
+	if got, want := resultMessage(review.Response), "AdmissionReview.Request is nil"; got != want {
+		t.Errorf("message = %q, want %q", got, want)
+	}
+}
+
+func TestMutateMatchesAnyTargetPrefix(t *testing.T) {
+	t.Setenv("TARGET_LABEL_PREFIXES", " canary.example.com/ , ,rollouts-pod-template-hash ")
+	cfg := testConfig(t)
+	if want := []string{"canary.example.com/", "rollouts-pod-template-hash"}; !reflect.DeepEqual(cfg.TargetLabelPrefixes, want) {
+		t.Fatalf("TargetLabelPrefixes = %q, want %q", cfg.TargetLabelPrefixes, want)
+	}
+	wh := newTestWebhook(t, cfg, &fakeLabelSource{labels: map[string]string{"team": "payments"}})
+
+	resp := wh.mutate(context.Background(), podReview(t, testPod(map[string]string{"rollouts-pod-template-hash": "abc"}), admissionv1.Create))
+
+	if len(resp.Patch) == 0 {
+		t.Errorf("pod matching the second prefix was not mutated: %s", resultMessage(resp))
+	}
+}
+
+func TestMutateDryRun(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.EmitEvents = true
+	source := &fakeLabelSource{labels: map[string]string{"team": "microservices"}}
+	wh := newTestWebhook(t, cfg, source)
+	// Creates are counted rather than listed, as the fake clientset ignores
+	// GenerateName.
+	var creates atomic.Int32
+	wh.client.(*fake.Clientset).PrependReactor("create", "events", func(k8stesting.Action) (bool, runtime.Object, error) {
+		creates.Add(1)
+		return false, nil, nil
+	})
+
+	dryRun := true
+	review := podReview(t, testPod(map[string]string{targetLabel: "abc"}), admissionv1.Create)
+	review.Request.DryRun = &dryRun
+	resp := wh.mutate(context.Background(), review)
+	if !resp.Allowed || len(resp.Patch) == 0 {
+		t.Fatalf("dry run = allowed %v, patch %s; want the patch that would apply", resp.Allowed, resp.Patch)
+	}
+
+	// A real admission afterwards emits its event; the dry run must not
+	// have tried to create one of its own.
+	review.Request.DryRun = nil
+	wh.mutate(context.Background(), review)
+	deadline := time.Now().Add(5 * time.Second)
+	for creates.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := creates.Load(); got != 1 {
+		t.Errorf("got %d event creates, want 1 from the real admission only", got)
+	}
+}
+
+func TestMutateExcludedNamespace(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.ExcludedNamespaces = []string{"kube-system", "apps"}
+	source := &fakeLabelSource{labels: map[string]string{"team": "microservices"}}
+	wh := newTestWebhook(t, cfg, source)
+
+	resp := wh.mutate(context.Background(), podReview(t, testPod(map[string]string{targetLabel: "abc"}), admissionv1.Create))
+
+	if !resp.Allowed || len(resp.Patch) != 0 {
+		t.Errorf("mutate = allowed %v, patch %s; want the pod passed through unchanged", resp.Allowed, resp.Patch)
+	}
+	if source.calls != 0 {
+		t.Errorf("label source called %d times, want 0 for an excluded namespace", source.calls)
+	}
+}
+
+func TestMutateLabelsAlreadySet(t *testing.T) {
+	source := &fakeLabelSource{labels: map[string]string{"team": "microservices"}}
+	wh := newTestWebhook(t, testConfig(t), source)
+
+	pod := testPod(map[string]string{targetLabel: "abc", "team": "microservices"})
+	resp := wh.mutate(context.Background(), podReview(t, pod, admissionv1.Create))
+
+	if !resp.Allowed {
+		t.Fatalf("mutate denied the request: %s", resultMessage(resp))
+	}
+	if ops := decodePatch(t, resp); ops != nil {
+		t.Errorf("patch = %+v, want none when the labels already match", ops)
+	}
+}
+
+func TestServeMutateEchoesUID(t *testing.T) {
+	valid, err := json.Marshal(podReview(t, testPod(map[string]string{targetLabel: "abc"}), admissionv1.Create))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		body     []byte
+		wantCode int
+	}{
+		{name: "admitted", body: valid, wantCode: http.StatusOK},
+		{
+			name:     "request that fails to unmarshal",
+			body:     []byte(`{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview","request":{"uid":"test-uid","operation":5}}`),
+			wantCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wh := newTestWebhook(t, testConfig(t), &fakeLabelSource{labels: map[string]string{"team": "microservices"}})
+
+			code, review := serveReview(t, wh, tt.body)
+
+			if code != tt.wantCode {
+				t.Errorf("status = %d, want %d", code, tt.wantCode)
+			}
+			if review.Response == nil || review.Response.UID != "test-uid" {
+				t.Errorf("response = %+v, want UID %q", review.Response, "test-uid")
+			}
+		})
+	}
+}
+
+func TestServeMutateWrongKindEchoesUID(t *testing.T) {
+	wh := newTestWebhook(t, testConfig(t), &fakeLabelSource{})
+
+	code, review := serveReview(t, wh, []byte(`{"apiVersion":"admission.k8s.io/v1","kind":"ConfigMap","request":{"uid":"test-uid"}}`))
+
+	if code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", code, http.StatusBadRequest)
+	}
+	if review.Response == nil || review.Response.Allowed {
+		t.Fatalf("response = %+v, want a denial", review.Response)
+	}
+	if review.Response.UID != "test-uid" {
+		t.Errorf("UID = %q, want %q", review.Response.UID, "test-uid")
+	}
+}
+
+func TestMutateSkipAnnotation(t *testing.T) {
+	tests := []struct {
+		value     string
+		wantPatch bool
+	}{
+		{value: "true"},
+		{value: "1"},
+		{value: "false", wantPatch: true},
+		{value: "maybe", wantPatch: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			source := &fakeLabelSource{labels: map[string]string{"team": "microservices"}}
+			wh := newTestWebhook(t, testConfig(t), source)
+			pod := testPod(map[string]string{targetLabel: "abc"})
+			pod.Annotations = map[string]string{defaultSkipAnnotation: tt.value}
+
+			resp := wh.mutate(context.Background(), podReview(t, pod, admissionv1.Create))
+
+			if !resp.Allowed {
+				t.Fatalf("mutate denied the request: %s", resultMessage(resp))
+			}
+			if got := len(resp.Patch) > 0; got != tt.wantPatch {
+				t.Errorf("patched = %v, want %v; patch %s", got, tt.wantPatch, resp.Patch)
+			}
+		})
+	}
+}
+
+func TestMutateInjectAs(t *testing.T) {
+	tests := []struct {
+		injectAs string
+		want     []patchOp
+	}{
+		{
+			injectAs: injectAsLabels,
+			want: []patchOp{
+				{Op: "add", Path: "/metadata/labels/team", Value: "microservices"},
+				{Op: "add", Path: "/metadata/annotations", Value: map[string]interface{}{}},
+				{Op: "add", Path: markerPath, Value: ""},
+			},
+		},
+		{
+			injectAs: injectAsAnnotations,
+			want: []patchOp{
+				{Op: "add", Path: "/metadata/annotations", Value: map[string]interface{}{}},
+				{Op: "add", Path: "/metadata/annotations/team", Value: "microservices"},
+				{Op: "add", Path: markerPath, Value: ""},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.injectAs, func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.InjectAs = tt.injectAs
+			wh := newTestWebhook(t, cfg, &fakeLabelSource{labels: map[string]string{"team": "microservices"}})
+
+			resp := wh.mutate(context.Background(), podReview(t, testPod(map[string]string{targetLabel: "abc"}), admissionv1.Create))
+
+			if !resp.Allowed {
+				t.Fatalf("mutate denied the request: %s", resultMessage(resp))
+			}
+			if got := decodePatch(t, resp); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("patch = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMutateInvalidLabelPolicy(t *testing.T) {
+	labels := map[string]string{"team": "microservices", "owner": "has spaces"}
+	tests := []struct {
+		policy      string
+		wantAllowed bool
+		want        []patchOp
+	}{
+		{
+			policy:      invalidLabelPolicySkip,
+			wantAllowed: true,
+			want: []patchOp{
+				{Op: "add", Path: "/metadata/labels/team", Value: "microservices"},
+				{Op: "add", Path: "/metadata/annotations", Value: map[string]interface{}{}},
+				{Op: "add", Path: markerPath, Value: ""},
+			},
+		},
+		{policy: invalidLabelPolicyDeny},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.InvalidLabelPolicy = tt.policy
+			wh := newTestWebhook(t, cfg, &fakeLabelSource{labels: labels})
+
+			resp := wh.mutate(context.Background(), podReview(t, testPod(map[string]string{targetLabel: "abc"}), admissionv1.Create))
+
+			if resp.Allowed != tt.wantAllowed {
+				t.Fatalf("allowed = %v, want %v: %s", resp.Allowed, tt.wantAllowed, resultMessage(resp))
+			}
+			if !resp.Allowed {
+				if resp.Result.Reason != reasonInvalidLabel || !strings.Contains(resp.Result.Message, "owner") {
+					t.Errorf("result = %+v, want %s naming the owner label", resp.Result, reasonInvalidLabel)
+				}
+				return
+			}
+			if got := decodePatch(t, resp); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("patch = %+v, want %+v", got, tt.want)
+			}
+			if len(resp.Warnings) == 0 {
+				t.Error("no warning for the skipped label")
+			}
+		})
+	}
+}
+
+func TestMutateCaseCollidingKeys(t *testing.T) {
+	source := &fakeLabelSource{labels: map[string]string{"team": "payments", "Team": "microservices"}}
+	wh := newTestWebhook(t, testConfig(t), source)
+
+	resp := wh.mutate(context.Background(), podReview(t, testPod(map[string]string{targetLabel: "abc"}), admissionv1.Create))
+
+	if !resp.Allowed {
+		t.Fatalf("mutate denied the request: %s", resultMessage(resp))
+	}
+	// The key sorting first wins, whatever the map order.
+	want := []patchOp{
+		{Op: "add", Path: "/metadata/labels/Team", Value: "microservices"},
+		{Op: "add", Path: "/metadata/annotations", Value: map[string]interface{}{}},
+		{Op: "add", Path: markerPath, Value: ""},
+	}
+	if got := decodePatch(t, resp); !reflect.DeepEqual(got, want) {
+		t.Errorf("patch = %+v, want %+v", got, want)
+	}
+	if len(resp.Warnings) != 1 || !strings.Contains(resp.Warnings[0], `"team"`) {
+		t.Errorf("warnings = %q, want one naming the dropped team key", resp.Warnings)
+	}
+}
+
+func TestMutateStaticLabelsMerge(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.StaticLabels = map[string]string{"team": "platform", "tier": "backend"}
+	wh := newTestWebhook(t, cfg, &fakeLabelSource{labels: map[string]string{"team": "microservices"}})
+
+	resp := wh.mutate(context.Background(), podReview(t, testPod(map[string]string{targetLabel: "abc"}), admissionv1.Create))
+
+	if !resp.Allowed {
+		t.Fatalf("mutate denied the request: %s", resultMessage(resp))
+	}
+	// The fetched team wins over the static one; tier comes from the static
+	// set alone.
+	want := []patchOp{
+		{Op: "add", Path: "/metadata/labels/team", Value: "microservices"},
+		{Op: "add", Path: "/metadata/labels/tier", Value: "backend"},
+		{Op: "add", Path: "/metadata/annotations", Value: map[string]interface{}{}},
+		{Op: "add", Path: markerPath, Value: ""},
+	}
+	if got := decodePatch(t, resp); !reflect.DeepEqual(got, want) {
+		t.Errorf("patch = %+v, want %+v", got, want)
+	}
+}
+
+func TestMutateFailOpen(t *testing.T) {
+	tests := []struct {
+		failOpen    bool
+		wantAllowed bool
+	}{
+		{failOpen: false, wantAllowed: false},
+		{failOpen: true, wantAllowed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("failOpen=%v", tt.failOpen), func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.FailOpen = tt.failOpen
+			wh := newTestWebhook(t, cfg, &fakeLabelSource{err: errors.New("label API down")})
+			errorsTotal := admissionErrorsTotal.WithLabelValues("apps", string(admissionv1.Create))
+			before := testutil.ToFloat64(errorsTotal)
+
+			resp := wh.mutate(context.Background(), podReview(t, testPod(map[string]string{targetLabel: "abc"}), admissionv1.Create))
+
+			if resp.Allowed != tt.wantAllowed {
+				t.Fatalf("allowed = %v, want %v: %s", resp.Allowed, tt.wantAllowed, resultMessage(resp))
+			}
+			if len(resp.Patch) != 0 {
+				t.Errorf("patch = %s, want none", resp.Patch)
+			}
+			if !resp.Allowed && !strings.Contains(resultMessage(resp), "label API down") {
+				t.Errorf("message = %q, want the fetch error", resultMessage(resp))
+			}
+			if got := testutil.ToFloat64(errorsTotal) - before; got != 1 {
+				t.Errorf("error metric went up by %v, want 1", got)
+			}
+		})
+	}
+}
+
+func TestMutateHandleOperations(t *testing.T) {
+	tests := []struct {
+		name       string
+		operations []string
+		operation  admissionv1.Operation
+		wantPatch  bool
+	}{
+		{name: "CREATE by default", operation: admissionv1.Create, wantPatch: true},
+		{name: "UPDATE skipped by default", operation: admissionv1.Update},
+		{name: "UPDATE when configured", operations: []string{"CREATE", "UPDATE"}, operation: admissionv1.Update, wantPatch: true},
+		{name: "CREATE skipped when not configured", operations: []string{"UPDATE"}, operation: admissionv1.Create},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t)
+			if tt.operations != nil {
+				cfg.HandleOperations = tt.operations
+			}
+			source := &fakeLabelSource{labels: map[string]string{"team": "microservices"}}
+			wh := newTestWebhook(t, cfg, source)
+
+			resp := wh.mutate(context.Background(), podReview(t, testPod(map[string]string{targetLabel: "abc"}), tt.operation))
+
+			if !resp.Allowed {
+				t.Fatalf("mutate denied the request: %s", resultMessage(resp))
+			}
+			if got := len(resp.Patch) > 0; got != tt.wantPatch {
+				t.Errorf("patched = %v, want %v; patch %s", got, tt.wantPatch, resp.Patch)
+			}
+			if !tt.wantPatch && source.calls != 0 {
+				t.Errorf("label source called %d times for an unhandled operation", source.calls)
+			}
+		})
+	}
+}
+
+func TestServeMutateOversizedBody(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.MaxBodyBytes = 1024
+	wh := newTestWebhook(t, cfg, &fakeLabelSource{})
+
+	pod := testPod(map[string]string{targetLabel: "abc"})
+	pod.Annotations = map[string]string{"padding": strings.Repeat("x", 2048)}
+	body, err := json.Marshal(podReview(t, pod, admissionv1.Create))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, review := serveReview(t, wh, body)
+
+	if code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want %d", code, http.StatusRequestEntityTooLarge)
+	}
+	if review.Response == nil || review.Response.Allowed {
+		t.Errorf("response = %+v, want a denial", review.Response)
+	}
+}
+
+func TestServeMutateReviewVersion(t *testing.T) {
+	v1beta1 := podReview(t, testPod(map[string]string{targetLabel: "abc"}), admissionv1.Create)
+	v1beta1.APIVersion = "admission.k8s.io/v1beta1"
+	v1beta1Body, err := json.Marshal(v1beta1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrongKind := podReview(t, testPod(map[string]string{targetLabel: "abc"}), admissionv1.Create)
+	wrongKind.Kind = "AdmissionRequest"
+	wrongKindBody, err := json.Marshal(wrongKind)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		body           []byte
+		wantCode       int
+		wantAPIVersion string
+		wantAllowed    bool
+	}{
+		{name: "v1beta1", body: v1beta1Body, wantCode: http.StatusOK, wantAPIVersion: "admission.k8s.io/v1beta1", wantAllowed: true},
+		{name: "wrong kind", body: wrongKindBody, wantCode: http.StatusBadRequest, wantAPIVersion: "admission.k8s.io/v1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wh := newTestWebhook(t, testConfig(t), &fakeLabelSource{labels: map[string]string{"team": "microservices"}})
+
+			code, review := serveReview(t, wh, tt.body)
+
+			if code != tt.wantCode {
+				t.Errorf("status = %d, want %d", code, tt.wantCode)
+			}
+			if review.APIVersion != tt.wantAPIVersion {
+				t.Errorf("apiVersion = %q, want %q", review.APIVersion, tt.wantAPIVersion)
+			}
+			if review.Response == nil || review.Response.Allowed != tt.wantAllowed {
+				t.Fatalf("response = %+v, want allowed %v", review.Response, tt.wantAllowed)
+			}
+			if tt.wantAllowed && len(review.Response.Patch) == 0 {
+				t.Error("no patch for the v1beta1 review")
+			}
+			if !tt.wantAllowed && !strings.Contains(resultMessage(review.Response), "Unsupported review") {
+				t.Errorf("message = %q, want it to name the unsupported review", resultMessage(review.Response))
+			}
+		})
+	}
+}
+
+func TestMutateLongValuePolicy(t *testing.T) {
+	long := strings.Repeat("a", 70)
+	labels := map[string]string{"team": "microservices", "owner": long}
+	tests := []struct {
+		policy      string
+		wantAllowed bool
+		want        []patchOp
+		wantWarning string
+	}{
+		{
+			policy:      longValuePolicySkip,
+			wantAllowed: true,
+			want: []patchOp{
+				{Op: "add", Path: "/metadata/labels/team", Value: "microservices"},
+				{Op: "add", Path: "/metadata/annotations", Value: map[string]interface{}{}},
+				{Op: "add", Path: markerPath, Value: ""},
+			},
+			wantWarning: `label "owner" skipped`,
+		},
+		{
+			policy:      longValuePolicyTruncate,
+			wantAllowed: true,
+			want: []patchOp{
+				{Op: "add", Path: "/metadata/labels/owner", Value: long[:63]},
+				{Op: "add", Path: "/metadata/labels/team", Value: "microservices"},
+				{Op: "add", Path: "/metadata/annotations", Value: map[string]interface{}{}},
+				{Op: "add", Path: markerPath, Value: ""},
+			},
+			wantWarning: `label "owner" value truncated`,
+		},
+		{policy: longValuePolicyDeny},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.LongValuePolicy = tt.policy
+			wh := newTestWebhook(t, cfg, &fakeLabelSource{labels: labels})
+
+			resp := wh.mutate(context.Background(), podReview(t, testPod(map[string]string{targetLabel: "abc"}), admissionv1.Create))
+
+			if resp.Allowed != tt.wantAllowed {
+				t.Fatalf("allowed = %v, want %v: %s", resp.Allowed, tt.wantAllowed, resultMessage(resp))
+			}
+			if !resp.Allowed {
+				if resp.Result.Reason != reasonInvalidLabel || !strings.Contains(resp.Result.Message, "owner") {
+					t.Errorf("result = %+v, want %s naming the owner label", resp.Result, reasonInvalidLabel)
+				}
+				return
+			}
+			if got := decodePatch(t, resp); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("patch = %+v, want %+v", got, tt.want)
+			}
+			if len(resp.Warnings) != 1 || !strings.Contains(resp.Warnings[0], tt.wantWarning) {
+				t.Errorf("warnings = %q, want one containing %q", resp.Warnings, tt.wantWarning)
+			}
+		})
+	}
+}
+
+func TestMutateEmptyLabelSet(t *testing.T) {
+	wh := newTestWebhook(t, testConfig(t), &fakeLabelSource{labels: map[string]string{}})
+
+	resp := wh.mutate(context.Background(), podReview(t, testPod(map[string]string{targetLabel: "abc"}), admissionv1.Create))
+
+	if !resp.Allowed {
+		t.Fatalf("mutate denied the request: %s", resultMessage(resp))
+	}
+	if resp.Patch != nil {
+		t.Errorf("patch = %s, want nil", resp.Patch)
+	}
+	if resp.PatchType != nil {
+		t.Errorf("PatchType = %v, want nil", *resp.PatchType)
+	}
+}
+
+func TestMutatePatchOrder(t *testing.T) {
+	labels := map[string]string{"zone": "a", "team": "microservices", "app.kubernetes.io/part-of": "shop", "cost-center": "42", "env": "prod"}
+	wh := newTestWebhook(t, testConfig(t), &fakeLabelSource{labels: labels})
+
+	// Map iteration order varies, so build the patch a few times.
+	for range 5 {
+		resp := wh.mutate(context.Background(), podReview(t, testPod(map[string]string{targetLabel: "abc"}), admissionv1.Create))
+		if !resp.Allowed {
+			t.Fatalf("mutate denied the request: %s", resultMessage(resp))
+		}
+		var paths []string
+		for _, op := range decodePatch(t, resp) {
+			if strings.HasPrefix(op.Path, "/metadata/labels/") {
+				paths = append(paths, op.Path)
+			}
+		}
+		want := []string{
+			"/metadata/labels/app.kubernetes.io~1part-of",
+			"/metadata/labels/cost-center",
+			"/metadata/labels/env",
+			"/metadata/labels/team",
+			"/metadata/labels/zone",
+		}
+		if !reflect.DeepEqual(paths, want) {
+			t.Fatalf("label ops = %q, want %q", paths, want)
+		}
+	}
+}
+
+func TestMutateRemoveLabels(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.RemoveLabels = []string{"legacy", "missing", "team"}
+	wh := newTestWebhook(t, cfg, &fakeLabelSource{labels: map[string]string{"team": "microservices"}})
+
+	pod := testPod(map[string]string{targetLabel: "abc", "legacy": "yes", "team": "old"})
+	review := podReview(t, pod, admissionv1.Create)
+	resp := wh.mutate(context.Background(), review)
+
+	if !resp.Allowed {
+		t.Fatalf("mutate denied the request: %s", resultMessage(resp))
+	}
+	// Only present keys are removed, and an injected key is kept.
+	want := []patchOp{
+		{Op: "replace", Path: "/metadata/labels/team", Value: "microservices"},
+		{Op: "remove", Path: "/metadata/labels/legacy"},
+		{Op: "add", Path: "/metadata/annotations", Value: map[string]interface{}{}},
+		{Op: "add", Path: markerPath, Value: ""},
+	}
+	if got := decodePatch(t, resp); !reflect.DeepEqual(got, want) {
+		t.Errorf("patch = %+v, want %+v", got, want)
+	}
+
+	patch, err := jsonpatch.DecodePatch(resp.Patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patched, err := patch.Apply(review.Request.Object.Raw)
+	if err != nil {
+		t.Fatalf("applying patch: %v", err)
+	}
+	var got corev1.Pod
+	if err := json.Unmarshal(patched, &got); err != nil {
+		t.Fatal(err)
+	}
+	if wantLabels := map[string]string{targetLabel: "abc", "team": "microservices"}; !reflect.DeepEqual(got.Labels, wantLabels) {
+		t.Errorf("patched labels = %v, want %v", got.Labels, wantLabels)
+	}
+}
+
+func TestServeDrain(t *testing.T) {
+	wh := newTestWebhook(t, testConfig(t), &fakeLabelSource{labels: map[string]string{"team": "microservices"}})
+	server := wh.newDrainServer(defaultDrainPort)
+	if want := "localhost:" + defaultDrainPort; server.Addr != want {
+		t.Errorf("drain server address = %q, want %q", server.Addr, want)
+	}
+
+	w := httptest.NewRecorder()
+	server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/drain", nil))
+	if w.Code != http.StatusMethodNotAllowed || wh.draining.Load() {
+		t.Fatalf("GET /drain = %d, draining %v; want %d and no drain", w.Code, wh.draining.Load(), http.StatusMethodNotAllowed)
+	}
+
+	w = httptest.NewRecorder()
+	server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/drain", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST /drain = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	w = httptest.NewRecorder()
+	wh.ServeReadyz(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz after /drain = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+
+	// Admission requests are still served while draining.
+	body, err := json.Marshal(podReview(t, testPod(map[string]string{targetLabel: "abc"}), admissionv1.Create))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, review := serveReview(t, wh, body); code != http.StatusOK || review.Response == nil || !review.Response.Allowed {
+		t.Errorf("/mutate while draining = %d, %+v; want it admitted", code, review.Response)
+	}
+}
+
+func TestMutateEmptyObject(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.HandleOperations = []string{"CREATE", "DELETE"}
+	source := &fakeLabelSource{labels: map[string]string{"team": "microservices"}}
+	wh := newTestWebhook(t, cfg, source)
+
+	review := podReview(t, testPod(map[string]string{targetLabel: "abc"}), admissionv1.Delete)
+	review.Request.Object = runtime.RawExtension{}
+	resp := wh.mutate(context.Background(), review)
+
+	if !resp.Allowed || len(resp.Patch) != 0 {
+		t.Errorf("mutate = allowed %v, patch %s; want allowed without a patch", resp.Allowed, resp.Patch)
+	}
+	if resp.Result != nil {
+		t.Errorf("result = %+v, want none", resp.Result)
+	}
+	if source.calls != 0 {
+		t.Errorf("label source called %d times, want 0 without an object", source.calls)
+	}
+}
+
+func TestDenialReasons(t *testing.T) {
+	mutate := (*Webhook).mutate
+	tests := []struct {
+		name       string
+		configure  func(*Config)
+		source     *fakeLabelSource
+		handler    func(*Webhook, context.Context, *admissionv1.AdmissionReview) *admissionv1.AdmissionResponse
+		wantReason metav1.StatusReason
+		wantCode   int32
+	}{
+		{
+			name:       "label fetch failed",
+			source:     &fakeLabelSource{err: errors.New("label API down")},
+			handler:    mutate,
+			wantReason: reasonLabelFetchFailed,
+			wantCode:   http.StatusServiceUnavailable,
+		},
+		{
+			name:       "invalid label",
+			configure:  func(cfg *Config) { cfg.InvalidLabelPolicy = invalidLabelPolicyDeny },
+			source:     &fakeLabelSource{labels: map[string]string{"team": "has spaces"}},
+			handler:    mutate,
+			wantReason: reasonInvalidLabel,
+			wantCode:   http.StatusUnprocessableEntity,
+		},
+		{
+			name:       "long label value",
+			configure:  func(cfg *Config) { cfg.LongValuePolicy = longValuePolicyDeny },
+			source:     &fakeLabelSource{labels: map[string]string{"team": strings.Repeat("a", 64)}},
+			handler:    mutate,
+			wantReason: reasonInvalidLabel,
+			wantCode:   http.StatusUnprocessableEntity,
+		},
+		{
+			name:       "forbidden label",
+			configure:  func(cfg *Config) { cfg.ForbiddenLabels = []string{targetLabel} },
+			source:     &fakeLabelSource{},
+			handler:    (*Webhook).validate,
+			wantReason: reasonForbiddenLabel,
+			wantCode:   http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t)
+			if tt.configure != nil {
+				tt.configure(&cfg)
+			}
+			wh := newTestWebhook(t, cfg, tt.source)
+
+			resp := tt.handler(wh, context.Background(), podReview(t, testPod(map[string]string{targetLabel: "abc"}), admissionv1.Create))
+
+			if resp.Allowed || resp.Result == nil {
+				t.Fatalf("response = %+v, want a denial with a result", resp)
+			}
+			if resp.Result.Reason != tt.wantReason || resp.Result.Code != tt.wantCode {
+				t.Errorf("reason, code = %q, %d; want %q, %d", resp.Result.Reason, resp.Result.Code, tt.wantReason, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestMutateReinvocation(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.RemoveLabels = []string{"legacy"}
+	cfg.InjectEnvName = "TEAM"
+	cfg.InjectEnvValue = "microservices"
+	// The sidecar must get the env var in the same patch.
+	cfg.Sidecar = &corev1.Container{Name: "proxy", Image: "proxy"}
+	wh := newTestWebhook(t, cfg, &fakeLabelSource{labels: map[string]string{"team": "microservices"}})
+
+	review := podReview(t, testPod(map[string]string{targetLabel: "abc", "legacy": "yes"}), admissionv1.Create)
+	first := wh.mutate(context.Background(), review)
+	if !first.Allowed || len(first.Patch) == 0 {
+		t.Fatalf("first call = allowed %v, patch %s; want a patch", first.Allowed, first.Patch)
+	}
+
+	// The API server reinvokes the webhook with the pod it already patched.
+	patch, err := jsonpatch.DecodePatch(first.Patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if review.Request.Object.Raw, err = patch.Apply(review.Request.Object.Raw); err != nil {
+		t.Fatalf("applying patch: %v", err)
+	}
+	var patched corev1.Pod
+	if err := json.Unmarshal(review.Request.Object.Raw, &patched); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(patched.Spec.Containers); n != 2 || !hasEnvVar(patched.Spec.Containers[1].Env, "TEAM") {
+		t.Errorf("patched containers = %+v, want the sidecar appended with TEAM set", patched.Spec.Containers)
+	}
+	if cfg.Sidecar.Env != nil {
+		t.Errorf("configured sidecar env = %+v, want it left unmodified", cfg.Sidecar.Env)
+	}
+	second := wh.mutate(context.Background(), review)
+
+	if !second.Allowed {
+		t.Fatalf("reinvocation denied: %s", resultMessage(second))
+	}
+	if second.Patch != nil || second.PatchType != nil {
+		t.Errorf("reinvocation patch = %s, type %v; want neither", second.Patch, second.PatchType)
+	}
+}
+
+func TestPatchTypeOnlyWithPatch(t *testing.T) {
+	tests := []struct {
+		name      string
+		pod       *corev1.Pod
+		wantPatch bool
+	}{
+		{name: "allowed, no patch", pod: testPod(map[string]string{"app": "web"})},
+		{name: "allowed, with patch", pod: testPod(map[string]string{targetLabel: "abc"}), wantPatch: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wh := newTestWebhook(t, testConfig(t), &fakeLabelSource{labels: map[string]string{"team": "microservices"}})
+			body, err := json.Marshal(podReview(t, tt.pod, admissionv1.Create))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			code, review := serveReview(t, wh, body)
+
+			if code != http.StatusOK || review.Response == nil || !review.Response.Allowed {
+				t.Fatalf("response = %d, %+v; want allowed", code, review.Response)
+			}
+			resp := review.Response
+			if got := len(resp.Patch) > 0; got != tt.wantPatch {
+				t.Errorf("patched = %v, want %v", got, tt.wantPatch)
+			}
+			if tt.wantPatch && (resp.PatchType == nil || *resp.PatchType != admissionv1.PatchTypeJSONPatch) {
+				t.Errorf("PatchType = %v, want JSONPatch", resp.PatchType)
+			}
+			if !tt.wantPatch && resp.PatchType != nil {
+				t.Errorf("PatchType = %v, want nil without a patch", *resp.PatchType)
+			}
+		})
+	}
+
+	// A patch type set without a patch on any path is dropped on the way
+	// out.
+	patchType := admissionv1.PatchTypeJSONPatch
+	raw, err := marshalAdmissionReview("admission.k8s.io/v1", "test-uid", &admissionv1.AdmissionResponse{Allowed: true, PatchType: &patchType})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, []byte("patchType")) {
+		t.Errorf("marshalled review %s carries a patch type without a patch", raw)
+	}
+}
+
+// applyPatch applies the patch of resp to the object in review and decodes
+// the result as a pod.
+func applyPatch(t *testing.T, review *admissionv1.AdmissionReview, resp *admissionv1.AdmissionResponse) *corev1.Pod {
+	t.Helper()
+	patch, err := jsonpatch.DecodePatch(resp.Patch)
+	if err != nil {
+		t.Fatalf("decoding patch %s: %v", resp.Patch, err)
+	}
+	patched, err := patch.Apply(review.Request.Object.Raw)
+	if err != nil {
+		t.Fatalf("applying patch %s: %v", resp.Patch, err)
+	}
+	var pod corev1.Pod
+	if err := json.Unmarshal(patched, &pod); err != nil {
+		t.Fatalf("decoding patched pod: %v", err)
+	}
+	return &pod
+}
+
+func TestMutateInjectEnv(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.InjectEnvName = "CLUSTER_NAME"
+	cfg.InjectEnvValue = "prod"
+	wh := newTestWebhook(t, cfg, &fakeLabelSource{labels: map[string]string{"team": "microservices"}})
+
+	pod := testPod(map[string]string{targetLabel: "abc"})
+	pod.Spec.Containers = []corev1.Container{
+		{Name: "no-env", Image: "app"},
+		{Name: "with-env", Image: "app", Env: []corev1.EnvVar{{Name: "LOG_LEVEL", Value: "info"}}},
+		{Name: "own-value", Image: "app", Env: []corev1.EnvVar{{Name: "CLUSTER_NAME", Value: "local"}}},
+	}
+	review := podReview(t, pod, admissionv1.Create)
+	resp := wh.mutate(context.Background(), review)
+	if !resp.Allowed {
+		t.Fatalf("mutate denied the request: %s", resultMessage(resp))
+	}
+
+	want := map[string][]corev1.EnvVar{
+		"no-env":    {{Name: "CLUSTER_NAME", Value: "prod"}},
+		"with-env":  {{Name: "LOG_LEVEL", Value: "info"}, {Name: "CLUSTER_NAME", Value: "prod"}},
+		"own-value": {{Name: "CLUSTER_NAME", Value: "local"}},
+	}
+	for _, container := range applyPatch(t, review, resp).Spec.Containers {
+		if !reflect.DeepEqual(container.Env, want[container.Name]) {
+			t.Errorf("container %s env = %v, want %v", container.Name, container.Env, want[container.Name])
+		}
+	}
+}
+
+func TestMutateInjectEnvInitContainers(t *testing.T) {
+	pod := testPod(map[string]string{targetLabel: "abc"})
+	pod.Spec.InitContainers = []corev1.Container{
+		{Name: "init-no-env", Image: "init"},
+		{Name: "init-with-env", Image: "init", Env: []corev1.EnvVar{{Name: "LOG_LEVEL", Value: "info"}}},
+	}
+	injected := []corev1.EnvVar{{Name: "CLUSTER_NAME", Value: "prod"}}
+
+	for _, include := range []bool{false, true} {
+		t.Run(fmt.Sprintf("INCLUDE_INIT_CONTAINERS=%v", include), func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.InjectEnvName = "CLUSTER_NAME"
+			cfg.InjectEnvValue = "prod"
+			cfg.IncludeInitContainers = include
+			wh := newTestWebhook(t, cfg, &fakeLabelSource{labels: map[string]string{"team": "microservices"}})
+			review := podReview(t, pod, admissionv1.Create)
+
+			resp := wh.mutate(context.Background(), review)
+			if !resp.Allowed {
+				t.Fatalf("mutate denied the request: %s", resultMessage(resp))
+			}
+
+			patched := applyPatch(t, review, resp)
+			if got := patched.Spec.Containers[0].Env; !reflect.DeepEqual(got, injected) {
+				t.Errorf("container app env = %v, want %v", got, injected)
+			}
+			want := map[string][]corev1.EnvVar{
+				"init-no-env":   nil,
+				"init-with-env": {{Name: "LOG_LEVEL", Value: "info"}},
+			}
+			if include {
+				want["init-no-env"] = injected
+				want["init-with-env"] = append(want["init-with-env"], injected...)
+			}
+			for _, container := range patched.Spec.InitContainers {
+				if !reflect.DeepEqual(container.Env, want[container.Name]) {
+					t.Errorf("init container %s env = %v, want %v", container.Name, container.Env, want[container.Name])
+				}
+			}
+		})
+	}
+}
+
+func TestMutateEmitsEvent(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.EmitEvents = true
+	wh := newTestWebhook(t, cfg, &fakeLabelSource{labels: map[string]string{"team": "microservices"}})
+	// Creates are counted as well as listed, as the fake clientset ignores
+	// GenerateName and would reject a second event.
+	var creates atomic.Int32
+	wh.client.(*fake.Clientset).PrependReactor("create", "events", func(k8stesting.Action) (bool, runtime.Object, error) {
+		creates.Add(1)
+		return false, nil, nil
+	})
+
+	// A controller-created pod has no name yet, only a generateName; it
+	// gets no event. A named one does.
+	unnamed := testPod(map[string]string{targetLabel: "abc"})
+	unnamed.Name, unnamed.GenerateName = "", "web-5d8f-"
+	wh.mutate(context.Background(), podReview(t, unnamed, admissionv1.Create))
+	wh.mutate(context.Background(), podReview(t, testPod(map[string]string{targetLabel: "abc"}), admissionv1.Create))
+
+	var events *corev1.EventList
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var err error
+		events, err = wh.client.CoreV1().Events("apps").List(context.Background(), metav1.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events.Items) > 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(events.Items) != 1 || creates.Load() != 1 {
+		t.Fatalf("got %d events from %d creates, want 1 for the named pod", len(events.Items), creates.Load())
+	}
+	event := events.Items[0]
+	if event.InvolvedObject.Kind != "Pod" || event.InvolvedObject.Name != "web" {
+		t.Errorf("event involves %s %q, want Pod %q", event.InvolvedObject.Kind, event.InvolvedObject.Name, "web")
+	}
+	if event.Reason != "LabelsInjected" || event.Message != "Applied labels: team=microservices" {
+		t.Errorf("event = %s %q, want LabelsInjected listing team=microservices", event.Reason, event.Message)
+	}
+}
+
+func TestMutateAllowedLabelKeys(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.AllowedLabelKeys = []string{"team", "tier"}
+	labels := map[string]string{"team": "microservices", "tier": "backend", "owner": "alice"}
+	wh := newTestWebhook(t, cfg, &fakeLabelSource{labels: labels})
+
+	resp := wh.mutate(context.Background(), podReview(t, testPod(map[string]string{targetLabel: "abc"}), admissionv1.Create))
+
+	if !resp.Allowed {
+		t.Fatalf("mutate denied the request: %s", resultMessage(resp))
+	}
+	want := []patchOp{
+		{Op: "add", Path: "/metadata/labels/team", Value: "microservices"},
+		{Op: "add", Path: "/metadata/labels/tier", Value: "backend"},
+		{Op: "add", Path: "/metadata/annotations", Value: map[string]interface{}{}},
+		{Op: "add", Path: markerPath, Value: ""},
+	}
+	if got := decodePatch(t, resp); !reflect.DeepEqual(got, want) {
+		t.Errorf("patch = %+v, want %+v", got, want)
+	}
+}
+
+// blockingLabelSource blocks every fetch until its context is done.
+type blockingLabelSource struct{}
+
+func (blockingLabelSource) Fetch(ctx context.Context, _ string) (map[string]string, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestServeMutateHandlerTimeout(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.HandlerTimeout = 50 * time.Millisecond
+	wh := newTestWebhook(t, cfg, blockingLabelSource{})
+	body, err := json.Marshal(podReview(t, testPod(map[string]string{targetLabel: "abc"}), admissionv1.Create))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	code, review := serveReview(t, wh, body)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("handling took %v, want it bounded by the 50ms handler timeout", elapsed)
+	}
+
+	if code != http.StatusOK || review.Response == nil || review.Response.Allowed {
+		t.Fatalf("response = %d, %+v; want a denial", code, review.Response)
+	}
+	if msg := resultMessage(review.Response); !strings.Contains(msg, "handler timeout of 50ms exceeded") {
+		t.Errorf("message = %q, want the handler timeout", msg)
+	}
+}
+
+func TestIsTargetKey(t *testing.T) {
+	tests := []struct {
+		key    string
+		prefix bool
+		exact  bool
+	}{
+		{"canary.example.com/track", true, false},
+		{"canary.example.com/", true, true},
+		{"rollouts-pod-template-hash", true, true},
+		{"rollouts-pod-template-hash-v2", true, false},
+		{"app", false, false},
+	}
+	for _, mode := range []string{targetLabelMatchPrefix, targetLabelMatchExact} {
+		t.Setenv("TARGET_LABEL_PREFIXES", "canary.example.com/,rollouts-pod-template-hash")
+		t.Setenv("TARGET_LABEL_MATCH", mode)
+		wh := newTestWebhook(t, testConfig(t), &fakeLabelSource{})
+		for _, tt := range tests {
+			want := tt.prefix
+			if mode == targetLabelMatchExact {
+				want = tt.exact
+			}
+			if got := wh.isTargetKey(tt.key); got != want {
+				t.Errorf("%s mode: isTargetKey(%q) = %v, want %v", mode, tt.key, got, want)
+			}
+		}
+	}
+}
+
+func TestIsTargetKeyRegex(t *testing.T) {
+	t.Setenv("TARGET_LABEL_MATCH", targetLabelMatchRegex)
+	t.Setenv("TARGET_LABEL_PATTERN", `^canary\.example\.com/(track|weight)$`)
+	wh := newTestWebhook(t, testConfig(t), &fakeLabelSource{})
+
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"canary.example.com/track", true},
+		{"canary.example.com/weight", true},
+		{"canary.example.com/tracking", false},
+		{"canaryXexample.com/track", false},
+		{"rollouts-pod-template-hash", false},
+	}
+	for _, tt := range tests {
+		if got := wh.isTargetKey(tt.key); got != tt.want {
+			t.Errorf("isTargetKey(%q) = %v, want %v", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestMutateSkipsEphemeralContainersSubresource(t *testing.T) {
+	cfg := testConfig(t)
+	// Handle UPDATE so only the subresource can explain a skip.
+	cfg.HandleOperations = []string{string(admissionv1.Create), string(admissionv1.Update)}
+	source := &fakeLabelSource{labels: map[string]string{"team": "payments"}}
+	wh := newTestWebhook(t, cfg, source)
+	review := podReview(t, testPod(map[string]string{targetLabel: "abc"}), admissionv1.Update)
+	review.Request.SubResource = "ephemeralcontainers"
+
+	if isPodRequest(review.Request) {
+		t.Error("isPodRequest = true for the pods/ephemeralcontainers subresource")
+	}
+	resp := wh.mutate(context.Background(), review)
+
+	if !resp.Allowed || len(resp.Patch) != 0 {
+		t.Errorf("response = allowed %v, patch %s; want allowed without a patch", resp.Allowed, resp.Patch)
+	}
+	if source.calls != 0 {
+		t.Errorf("label source called %d times, want 0", source.calls)
+	}
+}
+
+func TestMutateForceDeny(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.ForceDeny = true
+	source := &fakeLabelSource{labels: map[string]string{"team": "payments"}}
+	wh := newTestWebhook(t, cfg, source)
+	errorsTotal := admissionErrorsTotal.WithLabelValues("apps", string(admissionv1.Create))
+	before := testutil.ToFloat64(errorsTotal)
+
+	resp := wh.mutate(context.Background(), podReview(t, testPod(map[string]string{targetLabel: "abc"}), admissionv1.Create))
+
+	if resp.Allowed {
+		t.Fatal("FORCE_DENY allowed the pod")
+	}
+	if got := resultMessage(resp); got != defaultForceDenyMessage {
+		t.Errorf("message = %q, want %q", got, defaultForceDenyMessage)
+	}
+	if got := testutil.ToFloat64(errorsTotal) - before; got != 1 {
+		t.Errorf("error metric went up by %v, want 1", got)
+	}
+	if source.calls != 0 {
+		t.Errorf("label source called %d times, want 0", source.calls)
+	}
+}
+
+func TestWriteJSONError(t *testing.T) {
+	w := httptest.NewRecorder()
+
+	writeJSONError(w, http.StatusBadRequest, `bad "input"`)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if got := w.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+	var body map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decoding body %q: %v", w.Body, err)
+	}
+	if want := map[string]string{"error": `bad "input"`}; !reflect.DeepEqual(body, want) {
+		t.Errorf("body = %v, want %v", body, want)
+	}
+}
+
+func TestServeStatsCountsMutation(t *testing.T) {
+	wh := newTestWebhook(t, testConfig(t), &fakeLabelSource{labels: map[string]string{"team": "payments"}})
+	readStats := func() map[string]int64 {
+		t.Helper()
+		w := httptest.NewRecorder()
+		serveStats(w, httptest.NewRequest(http.MethodGet, "/stats", nil))
+		var got map[string]int64
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatalf("decoding stats %q: %v", w.Body, err)
+		}
+		return got
+	}
+	before := readStats()
+
+	body, err := json.Marshal(podReview(t, testPod(map[string]string{targetLabel: "abc"}), admissionv1.Create))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, review := serveReview(t, wh, body); len(review.Response.Patch) == 0 {
+		t.Fatalf("pod was not mutated: %+v", review.Response)
+	}
+
+	after := readStats()
+	for key, want := range map[string]int64{"total": 1, "mutated": 1, "allowed": 0, "denied": 0, "errors": 0} {
+		if got := after[key] - before[key]; got != want {
+			t.Errorf("%s went up by %d, want %d", key, got, want)
+		}
+	}
+}
+
+func TestMutateMaxPatchBytes(t *testing.T) {
+	// Enough labels, at the longest valid value, to pass the default limit.
+	labels := make(map[string]string, 12000)
+	for i := range 12000 {
+		labels[fmt.Sprintf("label-%05d", i)] = strings.Repeat("v", 63)
+	}
+	wh := newTestWebhook(t, testConfig(t), &fakeLabelSource{labels: labels})
+	errorsTotal := admissionErrorsTotal.WithLabelValues("apps", string(admissionv1.Create))
+	before := testutil.ToFloat64(errorsTotal)
+
+	resp := wh.mutate(context.Background(), podReview(t, testPod(map[string]string{targetLabel: "abc"}), admissionv1.Create))
+
+	if resp.Allowed {
+		t.Fatalf("patch for %d labels was allowed, want a MAX_PATCH_BYTES denial", len(labels))
+	}
+	if want := fmt.Sprintf("over the %d byte limit", defaultMaxPatchBytes); !strings.Contains(resultMessage(resp), want) {
+		t.Errorf("message = %q, want it to contain %q", resultMessage(resp), want)
+	}
+	if got := testutil.ToFloat64(errorsTotal) - before; got != 1 {
+		t.Errorf("error metric went up by %v, want 1", got)
+	}
+}
+
+func TestWriteNegotiated(t *testing.T) {
+	body := []byte(`{"version":"v1.2.3"}`)
+	tests := []struct {
+		accept          string
+		wantContentType string
+		wantBody        string
+	}{
+		{"", "application/json", `{"version":"v1.2.3"}`},
+		{"application/json", "application/json", `{"version":"v1.2.3"}`},
+		{"application/yaml", "application/yaml", "version: v1.2.3\n"},
+		{"text/html, application/x-yaml;q=0.9", "application/yaml", "version: v1.2.3\n"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/version", nil)
+		if tt.accept != "" {
+			r.Header.Set("Accept", tt.accept)
+		}
+		w := httptest.NewRecorder()
+
+		writeNegotiated(w, r, "application/json", body)
+
+		if got := w.Header().Get("Content-Type"); got != tt.wantContentType {
+			t.Errorf("Accept %q: Content-Type = %q, want %q", tt.accept, got, tt.wantContentType)
+		}
+		if got := w.Body.String(); got != tt.wantBody {
+			t.Errorf("Accept %q: body = %q, want %q", tt.accept, got, tt.wantBody)
+		}
+	}
+}
+
+func TestMutateEmptyNamespaceFetchesDefault(t *testing.T) {
+	for _, defaultNamespace := range []string{"", "shared"} {
+		t.Run("DEFAULT_NAMESPACE="+defaultNamespace, func(t *testing.T) {
+			t.Setenv("DEFAULT_NAMESPACE", defaultNamespace)
+			source := &fakeLabelSource{labels: map[string]string{"team": "payments"}}
+			wh := newTestWebhook(t, testConfig(t), source)
+			pod := testPod(map[string]string{targetLabel: "abc"})
+			pod.Namespace = ""
+
+			resp := wh.mutate(context.Background(), podReview(t, pod, admissionv1.Create))
+
+			if !resp.Allowed {
+				t.Fatalf("mutate denied the request: %s", resultMessage(resp))
+			}
+			want := defaultNamespace
+			if want == "" {
+				want = metav1.NamespaceDefault
+			}
+			if !reflect.DeepEqual(source.namespaces, []string{want}) {
+				t.Errorf("fetched namespaces = %q, want %q", source.namespaces, []string{want})
+			}
+		})
+	}
+}
+
+func TestMutateLogsPatchAtDebug(t *testing.T) {
+	for _, level := range []slog.Level{slog.LevelDebug, slog.LevelInfo} {
+		t.Run(level.String(), func(t *testing.T) {
+			var logs bytes.Buffer
+			logger := slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: level}))
+			wh, err := NewWebhook(fake.NewSimpleClientset(), &fakeLabelSource{labels: map[string]string{"team": "payments"}}, testConfig(t), logger)
+			if err != nil {
+				t.Fatalf("NewWebhook: %v", err)
+			}
+
+			resp := wh.mutate(context.Background(), podReview(t, testPod(map[string]string{targetLabel: "abc"}), admissionv1.Create))
+			if len(resp.Patch) == 0 {
+				t.Fatalf("pod was not mutated: %s", resultMessage(resp))
+			}
+
+			var logged []string
+			for _, line := range bytes.Split(bytes.TrimSpace(logs.Bytes()), []byte("\n")) {
+				var record struct {
+					Msg   string `json:"msg"`
+					Patch string `json:"patch"`
+				}
+				if err := json.Unmarshal(line, &record); err != nil {
+					t.Fatalf("decoding log line %q: %v", line, err)
+				}
+				if record.Msg == "Generated patch" {
+					logged = append(logged, record.Patch)
+				}
+			}
+			want := []string{string(resp.Patch)}
+			if level > slog.LevelDebug {
+				want = nil
+			}
+			if !reflect.DeepEqual(logged, want) {
+				t.Errorf("logged patches = %q, want %q", logged, want)
+			}
+		})
+	}
+}
+
+func TestListen(t *testing.T) {
+	tests := []struct {
+		bindAddress string
+		wantAddress string
+	}{
+		{"", ":0"},
+		{"127.0.0.1", "127.0.0.1:0"},
+		{"::1", "[::1]:0"},
+		{"[::1]", "[::1]:0"},
+	}
+	for _, tt := range tests {
+		cfg := testConfig(t)
+		cfg.BindAddress, cfg.Port = tt.bindAddress, "0"
+		if got := listenAddress(cfg); got != tt.wantAddress {
+			t.Errorf("listenAddress(BIND_ADDRESS=%q) = %q, want %q", tt.bindAddress, got, tt.wantAddress)
+		}
+	}
+
+	cfg := testConfig(t)
+	cfg.BindAddress, cfg.Port = "[::1]", "0"
+	listener, err := listen(cfg)
+	if err != nil {
+		t.Skipf("IPv6 loopback unavailable: %v", err)
+	}
+	defer listener.Close()
+	addr, ok := listener.Addr().(*net.TCPAddr)
+	if !ok || !addr.IP.Equal(net.IPv6loopback) || addr.Port == 0 {
+		t.Errorf("listening on %v, want ::1 on a chosen port", listener.Addr())
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"slices"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// podTemplateRoot is the JSON pointer to the pod template of the workload
+// kinds, under which their pod metadata and spec are patched.
+const podTemplateRoot = "/spec/template"
+
+// supportedWorkloadKinds are the apps/v1 kinds WORKLOAD_KINDS may enable.
+var supportedWorkloadKinds = []string{"Deployment", "StatefulSet", "DaemonSet"}
+
+// podRoot returns where the pod metadata and spec live within the admitted
+// object: "" for a pod and podTemplateRoot for an enabled workload kind. It
+// reports false for anything else.
+func (wh *Webhook) podRoot(req *admissionv1.AdmissionRequest) (string, bool) {
+	if isPodRequest(req) {
+		return "", true
+	}
+	if req.Kind.Group == "apps" && req.SubResource == "" && slices.Contains(wh.config.WorkloadKinds, req.Kind.Kind) {
+		return podTemplateRoot, true
+	}
+	return "", false
+}
+
+// decodePod decodes the pod at root in raw: the object itself when root is
+// empty, or a workload's pod template. A template is returned as a Pod
+// carrying the workload's name and owner references, so it is identified
+// like a pod in logs and owner lookups. With strict set, fields unknown to
+// the compiled-in API types are an error rather than silently dropped.
+func decodePod(raw []byte, root string, strict bool) (*corev1.Pod, error) {
+	var pod corev1.Pod
+	if root == "" {
+		if err := unmarshalJSON(raw, &pod, strict); err != nil {
+			return nil, err
+		}
+		return &pod, nil
+	}
+
+	var workload struct {
+		metav1.ObjectMeta `json:"metadata"`
+		Spec              struct {
+			Template corev1.PodTemplateSpec `json:"template"`
+		} `json:"spec"`
+	}
+	// The workload's own spec has many fields besides the template, so
+	// only the template is checked strictly.
+	if err := json.Unmarshal(raw, &workload); err != nil {
+		return nil, err
+	}
+	if strict {
+		var template struct {
+			Spec struct {
+				Template json.RawMessage `json:"template"`
+			} `json:"spec"`
+		}
+		if err := json.Unmarshal(raw, &template); err != nil {
+			return nil, err
+		}
+		if err := unmarshalJSON(template.Spec.Template, &corev1.PodTemplateSpec{}, true); err != nil {
+			return nil, err
+		}
+	}
+	pod.ObjectMeta = workload.Spec.Template.ObjectMeta
+	pod.Spec = workload.Spec.Template.Spec
+	pod.Name = workload.Name
+	pod.OwnerReferences = workload.OwnerReferences
+	return &pod, nil
+}
+
+// unmarshalJSON is json.Unmarshal, optionally rejecting unknown fields.
+func unmarshalJSON(data []byte, v interface{}, strict bool) error {
+	if !strict {
+		return json.Unmarshal(data, v)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
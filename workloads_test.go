@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestMutateDeployment(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.WorkloadKinds = []string{"Deployment"}
+	wh := newTestWebhook(t, cfg, &fakeLabelSource{labels: map[string]string{"team": "payments"}})
+
+	deployment := &appsv1.Deployment{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "apps"},
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{targetLabel: "abc"}},
+				Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "app"}}},
+			},
+		},
+	}
+	raw, err := json.Marshal(deployment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	review := &admissionv1.AdmissionReview{Request: &admissionv1.AdmissionRequest{
+		UID:       "test-uid",
+		Kind:      metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+		Resource:  metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"},
+		Name:      "web",
+		Namespace: "apps",
+		Operation: admissionv1.Create,
+		Object:    runtime.RawExtension{Raw: raw},
+	}}
+
+	resp := wh.mutate(context.Background(), review)
+
+	if !resp.Allowed {
+		t.Fatalf("mutate denied the request: %s", resultMessage(resp))
+	}
+	var ops []patchOp
+	if err := json.Unmarshal(resp.Patch, &ops); err != nil {
+		t.Fatalf("decoding patch %s: %v", resp.Patch, err)
+	}
+	templateMarkerPath := podTemplateRoot + markerPath
+	for i := range ops {
+		if ops[i].Path == templateMarkerPath {
+			ops[i].Value = ""
+		}
+	}
+	want := []patchOp{
+		{Op: "add", Path: "/spec/template/metadata/labels/team", Value: "payments"},
+		{Op: "add", Path: "/spec/template/metadata/annotations", Value: map[string]interface{}{}},
+		{Op: "add", Path: templateMarkerPath, Value: ""},
+	}
+	if !reflect.DeepEqual(ops, want) {
+		t.Errorf("patch = %+v, want %+v", ops, want)
+	}
+
+	patch, err := jsonpatch.DecodePatch(resp.Patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patched, err := patch.Apply(raw)
+	if err != nil {
+		t.Fatalf("applying patch %s: %v", resp.Patch, err)
+	}
+	var got appsv1.Deployment
+	if err := json.Unmarshal(patched, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Spec.Template.Labels["team"] != "payments" || len(got.Labels) != 0 {
+		t.Errorf("patched labels = %v, template labels = %v; want team on the template only", got.Labels, got.Spec.Template.Labels)
+	}
+}
+
+func TestDecodePodStrict(t *testing.T) {
+	tests := []struct {
+		name       string
+		raw        string
+		root       string
+		wantStrict bool // whether strict decoding succeeds
+	}{
+		{"known fields", `{"metadata":{"name":"web"},"spec":{"containers":[{"name":"app"}]}}`, "", true},
+		{"unknown pod field", `{"metadata":{"name":"web"},"spec":{"futureField":true}}`, "", false},
+		{"unknown template field", `{"metadata":{"name":"web"},"spec":{"template":{"spec":{"futureField":true}}}}`, podTemplateRoot, false},
+		// Only the template is checked in a workload.
+		{"unknown workload field", `{"metadata":{"name":"web"},"spec":{"futureField":true,"template":{}}}`, podTemplateRoot, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodePod([]byte(tt.raw), tt.root, false); err != nil {
+				t.Errorf("lenient decodePod: %v", err)
+			}
+			_, err := decodePod([]byte(tt.raw), tt.root, true)
+			if gotStrict := err == nil; gotStrict != tt.wantStrict {
+				t.Errorf("strict decodePod error = %v, want success %v", err, tt.wantStrict)
+			}
+		})
+	}
+}
+
+func TestMutateStrictDecode(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.StrictDecode = true
+	wh := newTestWebhook(t, cfg, &fakeLabelSource{labels: map[string]string{"team": "payments"}})
+	review := podReview(t, testPod(map[string]string{targetLabel: "abc"}), admissionv1.Create)
+	review.Request.Object.Raw = []byte(`{"metadata":{"name":"web","labels":{"` + targetLabel + `":"abc"}},"spec":{"futureField":true}}`)
+
+	resp := wh.mutate(context.Background(), review)
+
+	if resp.Allowed {
+		t.Fatal("pod with an unknown field was allowed, want a denial")
+	}
+	if msg := resultMessage(resp); !strings.Contains(msg, "futureField") {
+		t.Errorf("message = %q, want it to name the unknown field", msg)
+	}
+}